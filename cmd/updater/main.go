@@ -7,14 +7,25 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/kiemlicz/charter/internal/common"
 	"github.com/kiemlicz/charter/internal/packager"
-	"github.com/kiemlicz/charter/internal/updater/chart"
 	"github.com/kiemlicz/charter/internal/updater/git"
 	ghup "github.com/kiemlicz/charter/internal/updater/github"
+
+	// source types register themselves in common
+	_ "github.com/kiemlicz/charter/internal/updater/chart"
+	_ "github.com/kiemlicz/charter/internal/updater/composite"
+	_ "github.com/kiemlicz/charter/internal/updater/gitlab"
+	_ "github.com/kiemlicz/charter/internal/updater/kustomize"
+	_ "github.com/kiemlicz/charter/internal/updater/olm"
+	_ "github.com/kiemlicz/charter/internal/updater/plugin"
+	_ "github.com/kiemlicz/charter/internal/updater/web"
 )
 
 func main() {
@@ -23,12 +34,23 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 	common.Setup(config.Log.Level)
+	cache := common.NewCache(config.Cache.Dir, config.Offline)
+	githubClient, err := ghup.NewClient(&config.Github, nil, cache)
+	if err != nil {
+		log.Fatalf("Failed to create GitHub client: %v", err)
+	}
+	env := &common.SourceEnv{
+		Cache:   cache,
+		Clients: map[common.SourceType]any{common.SourceTypeGithub: githubClient},
+	}
 
 	switch config.ModeOfOperation {
 	case common.ModeUpdate:
-		err = UpdateMode(config)
+		err = UpdateMode(config, env)
 	case common.ModePublish:
 		err = PublishMode(config)
+	case common.ModeBackfill:
+		err = BackfillMode(config, env)
 	default:
 		err = fmt.Errorf("unsupported mode: %s", config.ModeOfOperation)
 	}
@@ -38,10 +60,10 @@ func main() {
 	}
 }
 
-func UpdateMode(config *common.Config) error {
+func UpdateMode(config *common.Config, env *common.SourceEnv) error {
 	mainCtx := context.Background()
 
-	sources, err := buildSources(config)
+	sources, err := buildSources(config, env)
 	if err != nil {
 		return fmt.Errorf("failed to build manifest sources: %w", err)
 	}
@@ -54,6 +76,26 @@ func UpdateMode(config *common.Config) error {
 	if err != nil {
 		return err
 	}
+	prClient := env.Clients[common.SourceTypeGithub].(*ghup.Client)
+	if config.PullRequest.AuthToken != "" && config.PullRequest.AuthToken != config.Github.AuthToken {
+		prSettings := config.Github
+		prSettings.AuthToken = config.PullRequest.AuthToken
+		if prClient, err = ghup.NewClient(&prSettings, nil, env.Cache); err != nil {
+			return err
+		}
+	}
+
+	// umbrella charts pin the merged versions of the dependencies not updated along with them, read before the update
+	chartDirs := make([]string, 0, len(sources))
+	for _, src := range sources {
+		if dir := config.Helm.ForLine(src.HelmOps().Line).SrcDir; !slices.Contains(chartDirs, dir) {
+			chartDirs = append(chartDirs, dir)
+		}
+	}
+	mergedCharts, err := packager.PeekMergedCharts(config.Umbrellas, chartDirs)
+	if err != nil {
+		return fmt.Errorf("failed to read umbrella charts: %w", err)
+	}
 
 	// Phase 1: fetch + prepare charts in parallel.
 	createdCharts := make(chan *packager.HelmizedManifests, len(sources))
@@ -62,7 +104,7 @@ func UpdateMode(config *common.Config) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			ctx, cancel := context.WithTimeout(mainCtx, 30*time.Second)
+			ctx, cancel := context.WithTimeout(mainCtx, timeout(config))
 			defer cancel()
 			charts, err := packager.FetchAndUpdate(ctx, src, &config.Helm)
 			if err != nil {
@@ -76,39 +118,26 @@ func UpdateMode(config *common.Config) error {
 	}
 	wg.Wait()
 	close(createdCharts)
+	updatedCharts := make([]*packager.HelmizedManifests, 0, len(sources))
+	for charts := range createdCharts {
+		if charts != nil {
+			updatedCharts = append(updatedCharts, charts)
+		}
+	}
 
 	if config.Offline {
+		for _, charts := range updatedCharts {
+			if err := updateUmbrellas(config, mergedCharts, charts); err != nil {
+				return err
+			}
+		}
 		common.Log.Infof("Offline mode, skipping git operations")
 		return nil
 	}
 
 	// Phase 2: commit / push / PR - must be serial to avoid git state conflicts.
-	timeoutCtx, cancel := context.WithTimeout(mainCtx, 30*time.Second)
-	defer cancel()
-	for charts := range createdCharts {
-		if charts == nil {
-			continue
-		}
-		branch := fmt.Sprintf("update/%s-%s", charts.Chart.Metadata.Name, charts.AppVersion())
-
-		exists, err := gitRepo.BranchExists(branch)
-		if err != nil {
-			return err
-		}
-		if exists {
-			common.Log.Warnf("Branch %s already exists: close it or merge it, then re-try, skipping", branch)
-			continue
-		}
-		if err = gitRepo.CreateBranch(config.PullRequest.DefaultBranch, branch); err != nil {
-			return err
-		}
-		if err = gitRepo.Commit(charts); err != nil {
-			return err
-		}
-		if err = gitRepo.Push(timeoutCtx, &config.PullRequest, branch); err != nil {
-			return err
-		}
-		if err = ghup.CreatePr(timeoutCtx, &config.PullRequest, branch); err != nil {
+	for _, charts := range updatedCharts {
+		if err := publishBranch(mainCtx, gitRepo, prClient, config, mergedCharts, charts); err != nil {
 			return err
 		}
 	}
@@ -116,57 +145,279 @@ func UpdateMode(config *common.Config) error {
 	return nil
 }
 
+// updateUmbrellas syncs the umbrella charts of the charts' release line depending on the charts, these are committed along with the charts
+func updateUmbrellas(config *common.Config, mergedCharts packager.MergedCharts, charts *packager.HelmizedManifests) error {
+	umbrellas, err := packager.UpdateUmbrellas(config.Umbrellas, mergedCharts, charts, config.Helm.ForLine(charts.Line))
+	if err != nil {
+		return fmt.Errorf("failed to update umbrella charts of %s: %w", charts.Chart.Metadata.Name, err)
+	}
+	charts.Umbrellas = umbrellas
+	return nil
+}
+
+// publishBranch commits the charts, with the umbrella charts depending on them, to their own branch, pushes it and opens the pull request
+func publishBranch(mainCtx context.Context, gitRepo *git.Client, prClient *ghup.Client, config *common.Config, mergedCharts packager.MergedCharts, charts *packager.HelmizedManifests) error {
+	timeoutCtx, cancel := context.WithTimeout(mainCtx, timeout(config))
+	defer cancel()
+
+	branch := fmt.Sprintf("update/%s-%s", charts.Chart.Metadata.Name, charts.AppVersion())
+	if charts.Line != "" {
+		branch = fmt.Sprintf("update/%s-%s-%s", charts.Chart.Metadata.Name, charts.Line, charts.AppVersion())
+	}
+
+	exists, err := gitRepo.BranchExists(branch)
+	if err != nil {
+		return err
+	}
+	if exists {
+		common.Log.Warnf("Branch %s already exists: close it or merge it, then re-try, skipping", branch)
+		return nil
+	}
+	if err = gitRepo.CreateBranch(config.PullRequest.DefaultBranch, branch); err != nil {
+		return err
+	}
+	// the umbrella charts are saved again for every branch, these may depend on the charts of several branches
+	if err = updateUmbrellas(config, mergedCharts, charts); err != nil {
+		return err
+	}
+	if err = gitRepo.Commit(charts); err != nil {
+		return err
+	}
+	if err = gitRepo.Push(timeoutCtx, &config.PullRequest, branch); err != nil {
+		return err
+	}
+	return ghup.CreatePr(timeoutCtx, prClient, &config.PullRequest, branch)
+}
+
 // PublishMode publishes the charts to the chart repository
-// iterates over all charts/* and releases them
+// iterates over all charts/* and charts/lines/*/* and releases them, umbrella charts are released last
 func PublishMode(config *common.Config) error {
 	common.Log.Infof("Publishing Charts")
-	files, err := os.ReadDir(config.Helm.SrcDir)
+	umbrellaPaths, err := publishCharts(config.Helm.SrcDir, config)
 	if err != nil {
-		return fmt.Errorf("failed to read charts directory: %w", err)
+		return err
+	}
+
+	linesDir := filepath.Join(config.Helm.SrcDir, common.LinesDir)
+	lines, err := os.ReadDir(linesDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read release lines directory: %w", err)
+	}
+	for _, line := range lines {
+		if line.IsDir() {
+			common.Log.Infof("Publishing Charts of release line: %s", line.Name())
+			lineUmbrellas, err := publishCharts(filepath.Join(linesDir, line.Name()), config)
+			if err != nil {
+				return err
+			}
+			umbrellaPaths = append(umbrellaPaths, lineUmbrellas...)
+		}
 	}
+	return publishUmbrellas(umbrellaPaths, config)
+}
+
+// publishCharts packages and pushes every chart directory found in dir, except umbrella charts whose paths are returned
+func publishCharts(dir string, config *common.Config) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read charts directory: %w", err)
+	}
+	umbrellaPaths := make([]string, 0)
 	for _, file := range files {
-		if file.IsDir() {
-			chartPath := filepath.Join(config.Helm.SrcDir, file.Name())
+		if file.IsDir() && file.Name() != common.LinesDir {
+			chartPath := filepath.Join(dir, file.Name())
 			common.Log.Infof("Found chart directory: %s", chartPath)
-			packagedPath, err := packager.Package(chartPath, &config.Helm)
+			umbrella, err := packager.IsUmbrella(chartPath)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if umbrella {
+				umbrellaPaths = append(umbrellaPaths, chartPath)
+				continue
 			}
-			ref, err := packager.Push(packagedPath, config.Helm.Remote)
+			packagedPath, err := packager.Package(chartPath, &config.Helm)
 			if err != nil {
-				if errors.Is(err, packager.ErrVersionExists) {
-					common.Log.Infof("Chart %s not published, already exists in desired version", file.Name())
-					continue
-				}
-				return err
+				return nil, err
 			}
-			common.Log.Infof("Chart %s published to %s", file.Name(), ref)
+			if err := publishChart(packagedPath, file.Name(), config); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return umbrellaPaths, nil
+}
+
+// publishUmbrellas packages the umbrella charts with their dependencies packaged by publishCharts and pushes them
+func publishUmbrellas(umbrellaPaths []string, config *common.Config) error {
+	for _, umbrellaPath := range umbrellaPaths {
+		common.Log.Infof("Publishing umbrella chart: %s", umbrellaPath)
+		packagedPath, err := packager.PackageUmbrella(umbrellaPath, &config.Helm)
+		if err != nil {
+			return err
+		}
+		if err := publishChart(packagedPath, filepath.Base(umbrellaPath), config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishChart(packagedPath, name string, config *common.Config) error {
+	ref, err := packager.Push(packagedPath, config.Helm.Remote)
+	if err != nil {
+		if errors.Is(err, packager.ErrVersionExists) {
+			common.Log.Infof("Chart %s not published, already exists in desired version", name)
+			return nil
+		}
+		return err
+	}
+	common.Log.Infof("Chart %s published to %s", name, ref)
+	return nil
+}
+
+// BackfillMode generates and packages charts for past upstream releases within the backfill.versions range
+// charts are generated in a temporary directory, the git repository is left untouched
+func BackfillMode(config *common.Config, env *common.SourceEnv) error {
+	mainCtx := context.Background()
+	backfill := &config.Backfill
+
+	index := slices.IndexFunc(config.Sources, func(spec common.SourceSpec) bool {
+		return spec.Helm.ChartName == backfill.Chart
+	})
+	if index < 0 {
+		return fmt.Errorf("no source configured for chart %q", backfill.Chart)
+	}
+	if strings.TrimSpace(backfill.Versions) == "" {
+		return fmt.Errorf("backfill of chart %s requires the versions range (e.g. --backfill.versions='>=1.4 <1.7')", backfill.Chart)
+	}
+	if _, err := semver.NewConstraint(backfill.Versions); err != nil {
+		return fmt.Errorf("invalid backfill versions range %q: %w", backfill.Versions, err)
+	}
+	spec := &config.Sources[index]
+	policy := spec.Release.ForLine(&common.ReleaseLine{Constraint: backfill.Versions})
+
+	source, err := common.NewSource(index, spec, policy, &spec.Helm, env)
+	if err != nil {
+		return err
+	}
+	lister, ok := source.(common.ReleaseLister)
+	if !ok {
+		return fmt.Errorf("source of chart %s (type %q) can't list past releases", backfill.Chart, spec.Type)
+	}
+	listCtx, cancel := context.WithTimeout(mainCtx, timeout(config))
+	defer cancel()
+	allTags, err := lister.ListReleases(listCtx)
+	if err != nil {
+		return fmt.Errorf("failed to list releases of %s: %w", backfill.Chart, err)
+	}
+	tags, err := policy.Filter(allTags)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		common.Log.Warnf("None of %d releases of %s matches %q, nothing to backfill", len(allTags), backfill.Chart, backfill.Versions)
+		return nil
+	}
+	common.Log.Infof("Backfilling %s releases: %v", backfill.Chart, tags)
+
+	srcDir, err := os.MkdirTemp("", "charter-backfill-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(srcDir)
+	settings := config.Helm
+	settings.SrcDir = srcDir
+
+	var errs []error
+	for _, tag := range tags {
+		if err := backfillRelease(mainCtx, env, index, spec, policy, tag, &settings, backfill.Publish, timeout(config)); err != nil {
+			common.Log.Errorf("Error backfilling %s release %s: %v", backfill.Chart, tag, err)
+			errs = append(errs, fmt.Errorf("release %s: %w", tag, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// backfillRelease generates the chart(s) of a single upstream release and packages (optionally publishes) them
+func backfillRelease(mainCtx context.Context, env *common.SourceEnv, index int, spec *common.SourceSpec, policy *common.ReleasePolicy, tag string, settings *common.HelmSettings, publish bool, timeout time.Duration) error {
+	pinned := *policy
+	pinned.Pin = tag
+	source, err := common.NewSource(index, spec, &pinned, &spec.Helm, env)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(mainCtx, timeout)
+	defer cancel()
+	manifests, err := source.Fetch(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	charts, err := packager.Prepare(manifests, source.HelmOps(), settings)
+	if err != nil {
+		return err
+	}
+
+	chartNames := []string{charts.Chart.Metadata.Name}
+	if charts.CrdChart != nil {
+		chartNames = append(chartNames, charts.CrdChart.Metadata.Name)
+	}
+	for _, name := range chartNames {
+		packagedPath, err := packager.Package(filepath.Join(charts.Path, name), settings)
+		if err != nil {
+			return err
+		}
+		if !publish {
+			continue
 		}
+		ref, err := packager.Push(packagedPath, settings.Remote)
+		if err != nil {
+			if errors.Is(err, packager.ErrVersionExists) {
+				common.Log.Infof("Chart %s not published, already exists in desired version", name)
+				continue
+			}
+			return err
+		}
+		common.Log.Infof("Chart %s published to %s", name, ref)
 	}
 	return nil
 }
 
 // buildSources converts the sources[] config into ManifestSource implementations.
-func buildSources(config *common.Config) ([]common.ManifestSource, error) {
+// Every release line of a source yields one more ManifestSource following that line.
+func buildSources(config *common.Config, env *common.SourceEnv) ([]common.ManifestSource, error) {
 	sources := make([]common.ManifestSource, 0, len(config.Sources))
 
 	for i := range config.Sources {
 		spec := &config.Sources[i]
-		switch spec.Type {
-		case common.SourceTypeGithub:
-			if spec.Github == nil {
-				return nil, fmt.Errorf("source %d has type 'github' but no 'github' block", i)
+		source, err := common.NewSource(i, spec, &spec.Release, &spec.Helm, env)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+
+		for j := range spec.Lines {
+			line := &spec.Lines[j]
+			if line.Name == "" || line.Name == "." || line.Name == ".." || strings.ContainsAny(line.Name, `/\`) {
+				return nil, fmt.Errorf("source %d has release line with invalid name: %q", i, line.Name)
 			}
-			sources = append(sources, ghup.NewGithubSource(spec.Github, &spec.Helm))
-		case common.SourceTypeHelmChart:
-			if spec.HelmChart == nil {
-				return nil, fmt.Errorf("source %d has type 'helmChart' but no 'helmChart' block", i)
+			lineHelm := spec.Helm
+			lineHelm.Line = line.Name
+			lineSource, err := common.NewSource(i, spec, spec.Release.ForLine(line), &lineHelm, env)
+			if err != nil {
+				return nil, err
 			}
-			sources = append(sources, chart.NewHelmChartSource(spec.HelmChart, &spec.Helm))
-		default:
-			return nil, fmt.Errorf("source %d has unknown type: %q", i, spec.Type)
+			sources = append(sources, lineSource)
 		}
 	}
 
 	return sources, nil
 }
+
+// timeout returns the configured bound of a source fetch or a pull request publishing
+func timeout(config *common.Config) time.Duration {
+	if config.Timeout > 0 {
+		return config.Timeout
+	}
+	return common.DefaultTimeout
+}
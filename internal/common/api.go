@@ -2,18 +2,28 @@ package common
 
 import (
 	"context"
+	"maps"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
 	"helm.sh/helm/v3/pkg/chart"
 )
 
 const (
-	ValuesRegex                 = `\{\{\s*\.Values\.([^\s\}]+).*?\}\}`
-	Kind                        = "kind"
-	ModeUpdate  ModeOfOperation = "update"
-	ModePublish ModeOfOperation = "publish"
+	ValuesRegex                  = `\{\{\s*\.Values\.([^\s\}]+).*?\}\}`
+	Kind                         = "kind"
+	ModeUpdate   ModeOfOperation = "update"
+	ModePublish  ModeOfOperation = "publish"
+	ModeBackfill ModeOfOperation = "backfill"
+	// LinesDir is the sub-directory of HelmSettings.SrcDir holding charts of the additional release lines
+	LinesDir = "lines"
+	// DefaultTimeout bounds the fetching of a source when Config.Timeout isn't set, outlasting the GitHub rate limit backoff
+	DefaultTimeout = 5 * time.Minute
 )
 
 // SourceType discriminates ManifestSource implementations in config.
@@ -22,8 +32,18 @@ type SourceType string
 const (
 	SourceTypeGithub    SourceType = "github"
 	SourceTypeHelmChart SourceType = "helmChart"
+	SourceTypeHttp      SourceType = "http"
+	SourceTypeGit       SourceType = "git"
+	SourceTypeKustomize SourceType = "kustomize"
+	SourceTypeGitlab    SourceType = "gitlab"
+	SourceTypeOlm       SourceType = "olm"
+	SourceTypeExec      SourceType = "exec"
+	SourceTypeComposite SourceType = "composite"
 )
 
+// ExecProtocolVersion is the version of the exec source protocol, programs must respond with the same version.
+const ExecProtocolVersion = "charter.exec/v1"
+
 // ManifestSource is the extension point for new upstream manifest origins.
 // Each implementation is responsible for its own version-staleness check:
 // returning (nil, nil) signals the existing chart is already up to date.
@@ -38,25 +58,161 @@ type ManifestSource interface {
 	HelmOps() *HelmOps
 }
 
+// ReleaseLister is implemented by sources able to enumerate past upstream releases (used by the backfill mode).
+type ReleaseLister interface {
+	// ListReleases returns the tags of all upstream releases, in no particular order.
+	ListReleases(ctx context.Context) ([]string, error)
+}
+
 // GithubSourceConfig holds GitHub-specific source parameters.
+// Assets select release assets by exact name, glob (e.g. "*-operator-v*.yaml")
+// or regex wrapped in slashes (e.g. "/^cdi-.*\.yaml$/"), each of them must match at least one asset.
+// Archived assets (.tar.gz, .tgz, .zip, .gz) are extracted keeping the files matching ArchivePaths globs
+// (all YAML files by default). Verify optionally checks the downloaded assets against the release's checksums and signature.
 type GithubSourceConfig struct {
-	Owner  string   `koanf:"owner"`
-	Repo   string   `koanf:"repo"`
-	Assets []string `koanf:"assets"`
+	Owner        string        `koanf:"owner"`
+	Repo         string        `koanf:"repo"`
+	Assets       []string      `koanf:"assets"`
+	ArchivePaths []string      `koanf:"archivePaths"`
+	Verify       *VerifyConfig `koanf:"verify"`
 }
 
-// HelmChartSourceConfig holds parameters for extracting CRDs from an existing Helm chart.
-// The crds/ sub-directory of the chart at SrcDir is used as the manifest origin.
+// GitlabSourceConfig holds GitLab-specific source parameters.
+// BaseUrl points to a self-hosted instance (defaults to https://gitlab.com),
+// Project is the numeric ID or the full path (e.g. "group/subgroup/project"),
+// Assets are names of the release asset links.
+// AuthToken (or GITLAB_TOKEN env) is required for private projects only.
+// Verify optionally checks the downloaded assets against the release's checksums and signature.
+type GitlabSourceConfig struct {
+	BaseUrl   string        `koanf:"baseUrl"`
+	Project   string        `koanf:"project"`
+	Assets    []string      `koanf:"assets"`
+	AuthToken string        `koanf:"authToken"`
+	Verify    *VerifyConfig `koanf:"verify"`
+}
+
+// HelmChartMode selects how HelmChartSource turns the source chart into manifests.
+type HelmChartMode string
+
+const (
+	// HelmChartModeCrds lifts the crds/ sub-directory of the source chart (default).
+	HelmChartModeCrds HelmChartMode = "crds"
+	// HelmChartModeRender renders the whole source chart with ValuesFile.
+	HelmChartModeRender HelmChartMode = "render"
+)
+
+// HelmChartSourceConfig holds parameters for producing manifests from an existing Helm chart.
+// The chart is either local (SrcDir) or pulled from a remote: Chart is an oci:// reference,
+// or a chart name within the classic (index.yaml) repository at Repo. Version is a SemVer constraint
+// for the pulled chart, the newest version is used when empty.
+// In the "crds" mode the crds/ sub-directory of the chart is used as the manifest origin,
+// in the "render" mode the chart is rendered (like `helm template`) as ReleaseName into Namespace.
 type HelmChartSourceConfig struct {
-	SrcDir string `koanf:"srcDir"`
+	SrcDir      string        `koanf:"srcDir"`
+	Chart       string        `koanf:"chart"`
+	Repo        string        `koanf:"repo"`
+	Version     string        `koanf:"version"`
+	Mode        HelmChartMode `koanf:"mode"`
+	ValuesFile  string        `koanf:"valuesFile"`
+	ReleaseName string        `koanf:"releaseName"`
+	Namespace   string        `koanf:"namespace"`
+}
+
+// HttpSourceConfig holds parameters for manifests published on plain web servers or buckets.
+// VersionUrl serves the upstream version, either as plain text or as a JSON/YAML document
+// from which VersionQuery (yq expression) selects it.
+// Assets are URL templates rendered with {{ .Version }} set to the discovered version.
+type HttpSourceConfig struct {
+	VersionUrl   string   `koanf:"versionUrl"`
+	VersionQuery string   `koanf:"versionQuery"`
+	Assets       []string `koanf:"assets"`
+}
+
+// GitSourceConfig holds parameters for manifests kept in-tree of an upstream git repository.
+// The repository is checked out at the tag selected by the source's release policy
+// (newest stable SemVer by default), only tags matching the optional TagPattern regex are considered,
+// Paths are glob patterns relative to the repository root, e.g. "deploy/*.yaml".
+type GitSourceConfig struct {
+	Url        string   `koanf:"url"`
+	TagPattern string   `koanf:"tagPattern"`
+	Paths      []string `koanf:"paths"`
+}
+
+// KustomizeSourceConfig holds parameters for rendering a kustomization.
+// When Git is set, Path is relative to the upstream repository checked out like for the git source (Git.Paths are ignored).
+// Otherwise Path is a local directory and Version names the rendered upstream release.
+type KustomizeSourceConfig struct {
+	Path    string           `koanf:"path"`
+	Version string           `koanf:"version"`
+	Git     *GitSourceConfig `koanf:"git"`
+}
+
+// OlmSourceConfig holds parameters for converting an Operator Lifecycle Manager bundle.
+// Path is the bundle directory (or the extracted filesystem of a bundle image) containing manifests/.
+type OlmSourceConfig struct {
+	Path string `koanf:"path"`
+}
+
+// ExecSourceConfig holds parameters for the external program producing manifests.
+// Command (looked up in PATH unless it contains a path separator) is run with Args in Dir (current directory when empty),
+// Env entries are added to the environment inherited from charter. The program speaks the exec protocol:
+// an ExecRequest is written to its stdin, an ExecResponse is read from its stdout, stderr is logged.
+type ExecSourceConfig struct {
+	Command string            `koanf:"command"`
+	Args    []string          `koanf:"args"`
+	Env     map[string]string `koanf:"env"`
+	Dir     string            `koanf:"dir"`
+}
+
+// CompositeSourceConfig combines the manifests of the child Sources into a single chart.
+// Each child is a regular source entry named by Name (an identifier, e.g. "cdi"), its helm block's drop and yq modifications
+// apply to the child's manifests only and its values are nested under Name to avoid collisions between the children.
+// The chart's AppVersion lists the children's versions (e.g. "kubevirt=v1.6.0,cdi=v1.62.0"), the chart is updated when any child changes,
+// the unchanged children are then fetched with their release policy pinned to the listed versions.
+// Version names the child the chart's Version follows ("max" of the children when empty),
+// the existing Version's patch is bumped when the derived one isn't newer, e.g. when only the other children changed.
+type CompositeSourceConfig struct {
+	Version string           `koanf:"version"`
+	Sources []CompositeChild `koanf:"sources"`
+}
+
+// CompositeChild is the source entry of a CompositeSourceConfig's child
+type CompositeChild struct {
+	Name       string `koanf:"name"`
+	SourceSpec `koanf:",squash"`
+}
+
+// ExecRequest is written as a JSON document to the stdin of the exec source's program.
+// CurrentVersion and CurrentAppVersion describe the existing chart, both are empty when the chart doesn't exist yet.
+type ExecRequest struct {
+	ProtocolVersion   string `json:"protocolVersion"`
+	ChartName         string `json:"chartName"`
+	CurrentVersion    string `json:"currentVersion"`
+	CurrentAppVersion string `json:"currentAppVersion"`
+}
+
+// ExecResponse is read as a JSON document from the stdout of the exec source's program.
+// UpToDate signals the existing chart is current, the remaining fields are ignored then.
+// Otherwise AppVersion (required) names the upstream release and Manifests hold its YAML (or JSON) documents,
+// each entry may contain multiple documents. Version sets the chart's version, derived from AppVersion when empty.
+type ExecResponse struct {
+	ProtocolVersion string   `json:"protocolVersion"`
+	UpToDate        bool     `json:"upToDate,omitempty"`
+	Version         string   `json:"version,omitempty"`
+	AppVersion      string   `json:"appVersion,omitempty"`
+	Manifests       []string `json:"manifests,omitempty"`
 }
 
 // SourceSpec is the tagged-union config entry for a single manifest source.
+// Release applies to sources following versioned upstream releases (github, gitlab, git, kustomize),
+// Lines are maintained by such sources in addition to the release selected by Release.
+// Blocks hold the remaining keys, the one named after Type configures the source (see RegisterSource).
 type SourceSpec struct {
-	Type      SourceType             `koanf:"type"`
-	Helm      HelmOps                `koanf:"helm"`
-	Github    *GithubSourceConfig    `koanf:"github"`
-	HelmChart *HelmChartSourceConfig `koanf:"helmChart"`
+	Type    SourceType     `koanf:"type"`
+	Helm    HelmOps        `koanf:"helm"`
+	Release ReleasePolicy  `koanf:"release"`
+	Lines   []ReleaseLine  `koanf:"lines"`
+	Blocks  map[string]any `koanf:",remain"`
 }
 
 var (
@@ -73,12 +229,28 @@ type Config struct {
 	ModeOfOperation ModeOfOperation `koanf:"mode"`
 	Offline         bool            `koanf:"offline"`
 
+	// Timeout bounds the fetching of each source and the push and pull request of each updated chart (DefaultTimeout when 0),
+	// it must outlast the rate limit backoffs (e.g. 2m of the GitHub client) for these to complete
+	Timeout time.Duration `koanf:"timeout"`
+
+	// Cache.Dir enables the on-disk cache of upstream downloads, offline runs are served from it.
+	Cache struct {
+		Dir string `koanf:"dir"`
+	} `koanf:"cache"`
+
 	PullRequest PullRequest `koanf:"pr"`
 
+	Github GithubSettings `koanf:"github"`
+
 	Helm HelmSettings `koanf:"helm"`
 
+	Backfill Backfill `koanf:"backfill"`
+
 	// Sources is the list of manifest origins.
 	Sources []SourceSpec `koanf:"sources"`
+
+	// Umbrellas are charts depending on the generated charts.
+	Umbrellas []Umbrella `koanf:"umbrellas"`
 }
 
 type PullRequest struct {
@@ -90,6 +262,39 @@ type PullRequest struct {
 	AuthToken     string `koanf:"authToken"`
 }
 
+// GithubSettings configures the GitHub API client shared by the github sources and pull requests.
+// ApiUrl and UploadUrl point to a GitHub Enterprise instance (e.g. "https://ghe.example.com/api/v3/"), github.com is used when empty.
+// AuthToken (or GITHUB_TOKEN env) authenticates the reads, raising the rate limits, pull requests use pr.authToken when set.
+// MaxRetries limits the retries of requests rejected by rate limits.
+type GithubSettings struct {
+	ApiUrl     string `koanf:"apiUrl"`
+	UploadUrl  string `koanf:"uploadUrl"`
+	AuthToken  string `koanf:"authToken"`
+	MaxRetries int    `koanf:"maxRetries"`
+}
+
+// Backfill selects the past upstream releases of the source producing Chart for which the backfill mode generates charts,
+// Versions is the required SemVer constraint (e.g. ">=1.4 <1.7"). Publish pushes the packaged charts to HelmSettings.Remote.
+type Backfill struct {
+	Chart    string `koanf:"chart"`
+	Versions string `koanf:"versions"`
+	Publish  bool   `koanf:"publish"`
+}
+
+// Umbrella declares a chart depending on generated charts (e.g. "kubevirt-crds" and "kubevirt") to install them together.
+// Its dependencies follow the versions of the generated charts, each change bumps the umbrella's Version patch,
+// AppVersion follows the first dependency. Dependencies are resolved from HelmSettings.Remote.
+type Umbrella struct {
+	Name         string               `koanf:"name"`
+	Dependencies []UmbrellaDependency `koanf:"dependencies"`
+}
+
+// UmbrellaDependency names the generated Chart, Condition optionally names the values key toggling it (e.g. "kubevirt.enabled")
+type UmbrellaDependency struct {
+	Chart     string `koanf:"chart"`
+	Condition string `koanf:"condition"`
+}
+
 type HelmSettings struct {
 	SrcDir    string `koanf:"srcDir"`
 	TargetDir string `koanf:"targetDir"`
@@ -97,26 +302,54 @@ type HelmSettings struct {
 	Remote    string `koanf:"remote"`
 }
 
+// ForLine returns the settings with SrcDir pointing to the storage of the release line, unchanged for the main line ("")
+func (s *HelmSettings) ForLine(line string) *HelmSettings {
+	if line == "" {
+		return s
+	}
+	settings := *s
+	settings.SrcDir = filepath.Join(s.SrcDir, LinesDir, line)
+	return &settings
+}
+
 type HelmOps struct {
 	ChartName     string         `koanf:"chartName"`
-	Drop          []string       `koanf:"drop"`
+	Drop          []string       `koanf:"drop"`          // kinds of resources to drop
+	DropSelectors []Selector     `koanf:"dropSelectors"` // resources to drop, matching any of the selectors
 	Modifications []Modification `koanf:"modifications"`
+	Optional      []Optional     `koanf:"optional"` // resources rendered only when enabled in values
 	AddValues     map[string]any `koanf:"addValues"`
 	AddCrdValues  map[string]any `koanf:"addCrdValues"`
 	SeparateCrds  bool           `koanf:"separateCrds"`
+	Line          string         `koanf:"-"` // release line name, empty for the main line
+}
+
+// Optional makes the selected resources conditional on the .Values.<ValuesKey>.enabled value
+type Optional struct {
+	Selector  Selector `koanf:"selector"`
+	ValuesKey string   `koanf:"valuesKey"` // dot-separated key under .Values holding the enabled toggle
+	Disabled  bool     `koanf:"disabled"`  // default of the toggle is false, the resources are rendered only when enabled explicitly
 }
 
 type Modification struct {
-	Expression     string   `koanf:"expression"`     // yq expression to modify manifest, when using TextRegex this is a regex replacement expression
-	TextRegex      string   `koanf:"textRegex"`      // regex to change the keys under path
-	ValuesSelector []string `koanf:"valuesSelector"` // cuts selected section and moves to Values
-	Kind           string   `koanf:"kind"`           // if set, apply modification only to resources of this kind
-	Reject         string   `koanf:"reject"`         // don't apply for these
+	Expression     string    `koanf:"expression"`     // yq expression to modify manifest, when using TextRegex this is a regex replacement expression
+	TextRegex      string    `koanf:"textRegex"`      // regex to change the keys under path
+	ValuesSelector []string  `koanf:"valuesSelector"` // cuts selected section and moves to Values
+	Kind           string    `koanf:"kind"`           // if set, apply modification only to resources of this kind
+	Reject         string    `koanf:"reject"`         // don't apply for these
+	Selector       *Selector `koanf:"selector"`       // if set, apply modification only to the selected resources, textRegex modifications match its kind only
+	Path           string    `koanf:"path"`           // if set, the field under this yq path is moved to Values under ValuesKey, Expression and ValuesSelector are generated
+	ValuesKey      string    `koanf:"valuesKey"`      // dot-separated key under .Values the field of Path is moved to
+	JsonPatch      string    `koanf:"jsonPatch"`      // RFC 6902 JSON Patch operations (YAML or JSON) applied instead of the Expression
+	// StrategicMergePatch is a Kubernetes strategic merge patch (YAML or JSON) applied instead of the Expression,
+	// kinds unknown to Kubernetes (custom resources) are patched with a JSON merge patch
+	StrategicMergePatch string `koanf:"strategicMergePatch"`
 }
 
+// Manifests are the resources of a release, kept as yq nodes preserving the upstream key order and comments
 type Manifests struct {
-	Crds       []map[string]any
-	Manifests  []map[string]any
+	Crds       []*yqlib.CandidateNode
+	Manifests  []*yqlib.CandidateNode
 	Version    semver.Version
 	AppVersion string
 	Values     map[string]any
@@ -128,21 +361,29 @@ func (m Manifests) ContainsCrds() bool {
 }
 
 func NewManifests(assetsData *map[string][]byte, version *semver.Version, appVersion string, initialValues *map[string]any, initialCrdValues *map[string]any) (*Manifests, error) {
-	crds := make([]map[string]any, 0)
-	manifests := make([]map[string]any, 0)
-
-	for assetName, assetData := range *assetsData {
-		maps, err := ExtractYamls(assetData)
+	// assets are read in the order of their names for the templates to be stable between runs
+	assetNames := slices.Sorted(maps.Keys(*assetsData))
+	nodes := make([]*yqlib.CandidateNode, 0)
+	for _, assetName := range assetNames {
+		assetNodes, err := ExtractManifests((*assetsData)[assetName])
 		if err != nil {
 			Log.Errorf("Failed to extract YAML from asset %s: %v", assetName, err)
 			return nil, err
 		}
-		for _, m := range *maps {
-			if kind, ok := m[Kind].(string); ok && strings.HasPrefix(kind, "CustomResourceDefinition") {
-				crds = append(crds, m)
-			} else {
-				manifests = append(manifests, m)
-			}
+		nodes = append(nodes, assetNodes...)
+	}
+	return NewManifestsOf(nodes, version, appVersion, initialValues, initialCrdValues), nil
+}
+
+// NewManifestsOf collects the decoded manifests, CRDs are split from the other resources keeping their order
+func NewManifestsOf(nodes []*yqlib.CandidateNode, version *semver.Version, appVersion string, initialValues *map[string]any, initialCrdValues *map[string]any) *Manifests {
+	crds := make([]*yqlib.CandidateNode, 0)
+	manifests := make([]*yqlib.CandidateNode, 0)
+	for _, m := range nodes {
+		if strings.HasPrefix(ManifestKind(m), "CustomResourceDefinition") {
+			crds = append(crds, m)
+		} else {
+			manifests = append(manifests, m)
 		}
 	}
 
@@ -154,7 +395,7 @@ func NewManifests(assetsData *map[string][]byte, version *semver.Version, appVer
 		AppVersion: appVersion,
 		Values:     *initialValues,
 		CrdsValues: *initialCrdValues,
-	}, nil
+	}
 }
 
 func NewYqModification(expression string) *Modification {
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+func TestNewManifests(t *testing.T) {
+	//given
+	assets := map[string][]byte{
+		"rbac.yaml":      []byte("kind: ServiceAccount\nmetadata:\n  name: operator\n---\nkind: Role\nmetadata:\n  name: operator\n"),
+		"operator.yaml":  []byte("kind: Deployment\nmetadata:\n  name: operator\n"),
+		"crds.yaml":      []byte("kind: CustomResourceDefinition\nmetadata:\n  name: things.example.com\n"),
+		"webhooks.yaml":  []byte("kind: Service\nmetadata:\n  name: webhook\n"),
+		"namespace.yaml": []byte("kind: Namespace\nmetadata:\n  name: operator-system\n"),
+	}
+
+	for range 10 {
+		//when
+		manifests, err := NewManifests(&assets, semver.MustParse("1.0.0"), "v1.0.0", &map[string]any{}, &map[string]any{})
+
+		//then
+		if err != nil {
+			t.Fatalf("NewManifests() error = %v", err)
+		}
+		kinds := make([]string, 0, len(manifests.Manifests))
+		for _, manifest := range manifests.Manifests {
+			kinds = append(kinds, ManifestKind(manifest))
+		}
+		if expected := "Namespace,Deployment,ServiceAccount,Role,Service"; strings.Join(kinds, ",") != expected {
+			t.Fatalf("NewManifests() kinds = %v, want the documents in the order of asset names: %s", kinds, expected)
+		}
+		if len(manifests.Crds) != 1 {
+			t.Fatalf("NewManifests() crds = %d, want 1", len(manifests.Crds))
+		}
+	}
+}
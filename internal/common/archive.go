@@ -0,0 +1,165 @@
+package common
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// DefaultArchivePaths selects files extracted from archived assets when no paths are configured.
+var DefaultArchivePaths = []string{"*.yaml", "*.yml"}
+
+// MatchesAsset reports whether the asset name matches the pattern:
+// a regex when wrapped in slashes (e.g. "/^cdi-.*\.yaml$/"), a glob otherwise (exact names are valid globs).
+func MatchesAsset(pattern, name string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return Matches(pattern[1:len(pattern)-1], name)
+	}
+	matched, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid asset pattern '%s': %w", pattern, err)
+	}
+	return matched, nil
+}
+
+// ExtractArchive unpacks .tar.gz/.tgz, .zip and .gz assets, keeping files matching any of the paths globs.
+// Globs containing "/" are matched against the full in-archive path, others against the file name only.
+// The returned keys are prefixed with the asset name, .gz assets are keyed by the decompressed name, non-archive assets are returned as they are.
+func ExtractArchive(assetName string, data []byte, paths []string) (map[string][]byte, error) {
+	if len(paths) == 0 {
+		paths = DefaultArchivePaths
+	}
+
+	var files map[string][]byte
+	var err error
+	prefix := assetName
+	switch {
+	case strings.HasSuffix(assetName, ".tar.gz") || strings.HasSuffix(assetName, ".tgz"):
+		files, err = extractTarGz(data, paths)
+	case strings.HasSuffix(assetName, ".zip"):
+		files, err = extractZip(data, paths)
+	case strings.HasSuffix(assetName, ".gz"):
+		var content []byte
+		content, err = gunzip(data)
+		files = map[string][]byte{strings.TrimSuffix(assetName, ".gz"): content}
+		prefix = ""
+	default:
+		return map[string][]byte{assetName: data}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract archive %s: %w", assetName, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("archive %s contains no files matching %v", assetName, paths)
+	}
+
+	extracted := make(map[string][]byte, len(files))
+	for name, content := range files {
+		if prefix != "" {
+			name = fmt.Sprintf("%s/%s", prefix, name)
+		}
+		extracted[name] = content
+	}
+	Log.Infof("Extracted %d files from archive %s", len(extracted), assetName)
+	return extracted, nil
+}
+
+func extractTarGz(data []byte, paths []string) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		selected, err := selectedPath(name, paths)
+		if err != nil {
+			return nil, err
+		}
+		if !selected {
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+func extractZip(data []byte, paths []string) (map[string][]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		selected, err := selectedPath(file.Name, paths)
+		if err != nil {
+			return nil, err
+		}
+		if !selected {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[file.Name] = content
+	}
+	return files, nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
+
+func selectedPath(name string, paths []string) (bool, error) {
+	for _, pattern := range paths {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		matched, err := path.Match(pattern, subject)
+		if err != nil {
+			return false, fmt.Errorf("invalid archive path pattern '%s': %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
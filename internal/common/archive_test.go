@@ -0,0 +1,206 @@
+package common
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testArchiveFiles are the files of the generated archives, "name: content"
+var testArchiveFiles = map[string]string{
+	"operator.yaml":              "kind: Deployment\n",
+	"deploy/crds/things.yaml":    "kind: CustomResourceDefinition\n",
+	"deploy/rbac/role.yml":       "kind: Role\n",
+	"deploy/examples/thing.json": "{}\n",
+	"README.md":                  "# operator\n",
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name      string
+		assetName string
+		data      []byte
+		paths     []string
+		want      []string
+	}{
+		{"tar.gz default paths", "operator.tar.gz", newTarGz(t, testArchiveFiles), nil,
+			[]string{"operator.tar.gz/deploy/crds/things.yaml", "operator.tar.gz/deploy/rbac/role.yml", "operator.tar.gz/operator.yaml"}},
+		{"tgz file name glob", "operator.tgz", newTarGz(t, testArchiveFiles), []string{"things.yaml"},
+			[]string{"operator.tgz/deploy/crds/things.yaml"}},
+		{"tar.gz in-archive path glob", "operator.tar.gz", newTarGz(t, testArchiveFiles), []string{"deploy/*/*.yaml"},
+			[]string{"operator.tar.gz/deploy/crds/things.yaml"}},
+		{"zip default paths", "operator.zip", newZip(t, testArchiveFiles), nil,
+			[]string{"operator.zip/deploy/crds/things.yaml", "operator.zip/deploy/rbac/role.yml", "operator.zip/operator.yaml"}},
+		{"zip in-archive path glob", "operator.zip", newZip(t, testArchiveFiles), []string{"deploy/rbac/*", "*.json"},
+			[]string{"operator.zip/deploy/examples/thing.json", "operator.zip/deploy/rbac/role.yml"}},
+		{"gz", "operator.yaml.gz", gzipped(t, testArchiveFiles["operator.yaml"]), nil,
+			[]string{"operator.yaml"}},
+		{"not an archive", "operator.yaml", []byte(testArchiveFiles["operator.yaml"]), []string{"*.json"},
+			[]string{"operator.yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			files, err := ExtractArchive(tt.assetName, tt.data, tt.paths)
+
+			//then
+			if err != nil {
+				t.Fatalf("ExtractArchive() error = %v", err)
+			}
+			names := make([]string, 0, len(files))
+			for name, content := range files {
+				names = append(names, name)
+				if original := testArchiveFiles[strings.TrimPrefix(name, tt.assetName+"/")]; string(content) != original {
+					t.Errorf("ExtractArchive() %s = %q, want %q", name, content, original)
+				}
+			}
+			slices.Sort(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("ExtractArchive() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		assetName string
+		data      []byte
+		paths     []string
+		wantErr   string
+	}{
+		{"no matching files", "operator.tar.gz", newTarGz(t, testArchiveFiles), []string{"*.json.gz"}, "contains no files matching"},
+		{"invalid pattern", "operator.zip", newZip(t, testArchiveFiles), []string{"[operator"}, "invalid archive path pattern"},
+		{"corrupted archive", "operator.tar.gz", []byte("not gzipped"), nil, "failed to extract"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			_, err := ExtractArchive(tt.assetName, tt.data, tt.paths)
+
+			//then
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ExtractArchive() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchesAsset(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		{"operator.yaml", "operator.yaml", true, false},
+		{"operator.yaml", "operator.yml", false, false},
+		{"*-operator-v*.yaml", "cdi-operator-v1.60.0.yaml", true, false},
+		{"*-operator-v*.yaml", "cdi-cr-v1.60.0.yaml", false, false},
+		{`/^cdi-.*\.yaml$/`, "cdi-operator.yaml", true, false},
+		{`/^cdi-.*\.yaml$/`, "kubevirt-operator.yaml", false, false},
+		{`/operator/`, "cdi-operator.yaml", true, false},
+		{"/", "/", true, false},
+		{"[cdi", "cdi-operator.yaml", false, true},
+		{"/[cdi/", "cdi-operator.yaml", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			//when
+			matches, err := MatchesAsset(tt.pattern, tt.name)
+
+			//then
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatchesAsset() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if matches != tt.want {
+				t.Errorf("MatchesAsset() = %t, want %t", matches, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectedPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  bool
+	}{
+		{"deploy/crds/things.yaml", []string{"*.yaml"}, true},
+		{"deploy/crds/things.yaml", []string{"deploy/*.yaml"}, false},
+		{"deploy/crds/things.yaml", []string{"deploy/crds/*.yaml"}, true},
+		{"deploy/crds/things.yaml", []string{"crds/*.yaml"}, false},
+		{"things.yaml", []string{"*/things.yaml"}, false},
+		{"deploy/crds/things.yaml", []string{"*.json", "things.*"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.name, tt.paths), func(t *testing.T) {
+			if selected, err := selectedPath(tt.name, tt.paths); err != nil || selected != tt.want {
+				t.Errorf("selectedPath() = %t, %v, want %t", selected, err, tt.want)
+			}
+		})
+	}
+}
+
+func newTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "./link.yaml", Linkname: "operator.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create("deploy/"); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,328 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotCached is returned in offline mode for content missing in the cache.
+var ErrNotCached = errors.New("not cached")
+
+// Cache stores downloaded content with its ETag/Last-Modified validators, cached content is revalidated
+// with conditional requests. In offline mode the content is served from the cache only.
+// The nil Cache (no cache directory configured) downloads everything directly.
+type Cache struct {
+	dir     string
+	offline bool
+}
+
+type cacheEntry struct {
+	Url          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+}
+
+// NewCache creates the download cache shared by the sources, caching is disabled (nil Cache) for an empty dir
+func NewCache(dir string, offline bool) *Cache {
+	if dir == "" {
+		if offline {
+			Log.Warnf("Offline mode without cache directory, upstream content is downloaded anyway")
+		}
+		return nil
+	}
+	Log.Infof("Using download cache in %s (offline: %t)", dir, offline)
+	return &Cache{dir: dir, offline: offline}
+}
+
+// Offline reports whether the content is served from the cache only
+func (c *Cache) Offline() bool {
+	return c != nil && c.offline
+}
+
+// Client returns an HTTP client caching the responses of GET requests (keyed by URL)
+func (c *Cache) Client() *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: c.Transport(http.DefaultTransport)}
+}
+
+// Transport wraps base with caching of successful GET responses keyed by URL, meant for release metadata APIs
+func (c *Cache) Transport(base http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return base
+	}
+	return &cachingTransport{cache: c, base: base}
+}
+
+// Fetch returns the content of the request's response stored under the key (e.g. source, tag and asset),
+// the request is sent conditionally when the content is cached already
+func (c *Cache) Fetch(client *http.Client, req *http.Request, key ...string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c == nil {
+		return get(client, req)
+	}
+
+	path := c.path(key...)
+	entry, body, err := c.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.offline {
+		if entry == nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(key, "/"), ErrNotCached)
+		}
+		return body, nil
+	}
+
+	entry.conditional(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		Log.Debugf("Cached %s is up to date", strings.Join(key, "/"))
+		return body, nil
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.store(path, req.URL.String(), resp.Header, data)
+		return data, nil
+	default:
+		return nil, fmt.Errorf("failed to download %s, status: %d", req.URL, resp.StatusCode)
+	}
+}
+
+// Immutable returns the content stored under the key, fetching and storing it when missing,
+// meant for content that never changes once published (e.g. the checkout of a git tag)
+func (c *Cache) Immutable(fetch func() ([]byte, error), key ...string) ([]byte, error) {
+	if c == nil {
+		return fetch()
+	}
+	path := c.path(key...)
+	entry, body, err := c.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		Log.Debugf("Using cached %s", strings.Join(key, "/"))
+		return body, nil
+	}
+	if c.offline {
+		return nil, fmt.Errorf("%s: %w", strings.Join(key, "/"), ErrNotCached)
+	}
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.store(path, strings.Join(key, "/"), nil, data)
+	return data, nil
+}
+
+// Latest fetches the content and stores it under the key, in offline mode the stored content is returned instead,
+// meant for content without validators that changes upstream (e.g. the tags of a git repository)
+func (c *Cache) Latest(fetch func() ([]byte, error), key ...string) ([]byte, error) {
+	if c == nil {
+		return fetch()
+	}
+	path := c.path(key...)
+	if c.offline {
+		entry, body, err := c.load(path)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(key, "/"), ErrNotCached)
+		}
+		return body, nil
+	}
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.store(path, strings.Join(key, "/"), nil, data)
+	return data, nil
+}
+
+type cachingTransport struct {
+	cache *Cache
+	base  http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	urlHash := sha256.Sum256([]byte(req.URL.String()))
+	path := t.cache.path("http", req.URL.Host, hex.EncodeToString(urlHash[:]))
+	entry, body, err := t.cache.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if t.cache.offline {
+		if entry == nil {
+			return nil, fmt.Errorf("%s: %w", req.URL, ErrNotCached)
+		}
+		return entry.response(req, body), nil
+	}
+
+	conditionalReq := req.Clone(req.Context())
+	entry.conditional(conditionalReq)
+	resp, err := t.base.RoundTrip(conditionalReq)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		resp.Body.Close()
+		Log.Debugf("Cached %s is up to date", req.URL)
+		return entry.response(req, body), nil
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.cache.store(path, req.URL.String(), resp.Header, data)
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return resp, nil
+	default:
+		return resp, nil
+	}
+}
+
+// conditional adds the validators of the cached content to the request
+func (e *cacheEntry) conditional(req *http.Request) {
+	if e == nil {
+		return
+	}
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+}
+
+func (e *cacheEntry) response(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// path maps the key to a file within the cache dir, each key element is escaped into a single path segment
+func (c *Cache) path(key ...string) string {
+	segments := make([]string, 0, len(key)+1)
+	segments = append(segments, c.dir)
+	for _, k := range key {
+		segment := url.PathEscape(k)
+		if segment == "" || segment == "." || segment == ".." {
+			segment = strings.Repeat("_", len(segment)+1)
+		}
+		segments = append(segments, segment)
+	}
+	return filepath.Join(segments...)
+}
+
+// load returns nil entry for content missing in the cache
+func (c *Cache) load(path string) (*cacheEntry, []byte, error) {
+	metadata, err := os.ReadFile(path + ".meta.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(metadata, &entry); err != nil {
+		Log.Warnf("Corrupted cache entry %s, ignoring: %v", path, err)
+		return nil, nil, nil
+	}
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &entry, body, nil
+}
+
+// store writes the content, failures only lose the cached copy
+func (c *Cache) store(path, sourceUrl string, header http.Header, body []byte) {
+	entry := cacheEntry{
+		Url:          sourceUrl,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Header:       header.Clone(),
+	}
+	metadata, err := json.Marshal(entry)
+	if err == nil {
+		err = writeAtomically(path, body)
+	}
+	if err == nil {
+		err = writeAtomically(path+".meta.json", metadata)
+	}
+	if err != nil {
+		Log.Warnf("Failed to cache %s: %v", sourceUrl, err)
+	}
+}
+
+func writeAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func get(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s, status: %d", req.URL, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+// ExtractManifests decodes the YAML documents of the asset to yq nodes keeping the upstream key order and comments,
+// empty documents (e.g. templates rendered to nothing) are skipped
+func ExtractManifests(assetData []byte) ([]*yqlib.CandidateNode, error) {
+	preferences := yqlib.NewDefaultYamlPreferences()
+	preferences.LeadingContentPreProcessing = false // leading comments become the first document's head comment
+	decoder := yqlib.NewYamlDecoder(preferences)
+	if err := decoder.Init(bytes.NewReader(assetData)); err != nil {
+		return nil, err
+	}
+
+	manifests := make([]*yqlib.CandidateNode, 0)
+	for {
+		node, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			Log.Errorf("Failed to decode YAML document for asset: %v", err)
+			return nil, err
+		}
+		if node.Kind != yqlib.MappingNode {
+			continue
+		}
+		manifests = append(manifests, node)
+	}
+
+	Log.Infof("Successfully decoded %d documents", len(manifests))
+	return manifests, nil
+}
+
+// Field returns the node under the keys of the manifest, nil when absent
+func Field(manifest *yqlib.CandidateNode, keys ...string) *yqlib.CandidateNode {
+	node := manifest
+	for _, key := range keys {
+		if node == nil || node.Kind != yqlib.MappingNode {
+			return nil
+		}
+		var value *yqlib.CandidateNode
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				value = node.Content[i+1]
+				break
+			}
+		}
+		node = value
+	}
+	return node
+}
+
+// FieldValue returns the scalar under the keys of the manifest, empty when absent
+func FieldValue(manifest *yqlib.CandidateNode, keys ...string) string {
+	node := Field(manifest, keys...)
+	if node == nil || node.Kind != yqlib.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+// ManifestKind returns the kind of the manifest
+func ManifestKind(manifest *yqlib.CandidateNode) string {
+	return FieldValue(manifest, Kind)
+}
+
+// ManifestMap decodes the manifest to a map, which doesn't keep the key order and comments
+func ManifestMap(manifest *yqlib.CandidateNode) (map[string]any, error) {
+	node, err := manifest.MarshalYAML()
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := node.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
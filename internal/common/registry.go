@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// SourceFactory creates the ManifestSource of a source entry from its decoded config block.
+type SourceFactory[C any] func(cfg *C, release *ReleasePolicy, helm *HelmOps, env *SourceEnv) (ManifestSource, error)
+
+// SourceEnv holds what the sources created from config share, set up once and handed to every factory.
+type SourceEnv struct {
+	// Cache is the download cache of upstream content, nil downloads everything directly
+	Cache *Cache
+	// Clients are the API clients shared by the sources of a type (e.g. the github package's *Client),
+	// sources create their default client when missing
+	Clients map[SourceType]any
+}
+
+// SourceTraits describe the capabilities of a registered source type.
+type SourceTraits struct {
+	// Versioned sources select among upstream releases with the ReleasePolicy, these support release lines.
+	Versioned bool
+}
+
+type sourceRegistration struct {
+	traits SourceTraits
+	create func(block any, release *ReleasePolicy, helm *HelmOps, env *SourceEnv) (ManifestSource, error)
+}
+
+var (
+	sourcesLock sync.RWMutex
+	sources     = make(map[SourceType]sourceRegistration)
+)
+
+// RegisterSource makes the source type available in config, the source entries of the type are configured
+// in the block named after the type, decoded into C like the rest of the config (koanf struct tags).
+// Source packages register their types in init, registering the same type twice panics.
+func RegisterSource[C any](sourceType SourceType, traits SourceTraits, factory SourceFactory[C]) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if _, exists := sources[sourceType]; exists {
+		panic(fmt.Sprintf("source type %q registered twice", sourceType))
+	}
+	sources[sourceType] = sourceRegistration{
+		traits: traits,
+		create: func(block any, release *ReleasePolicy, helm *HelmOps, env *SourceEnv) (ManifestSource, error) {
+			cfg := new(C)
+			if err := decodeBlock(block, cfg); err != nil {
+				return nil, err
+			}
+			return factory(cfg, release, helm, env)
+		},
+	}
+}
+
+// NewSource creates the ManifestSource of the i-th source entry with the registered factory of its type,
+// nil env creates the sources without the download cache and with their default clients
+func NewSource(i int, spec *SourceSpec, release *ReleasePolicy, helm *HelmOps, env *SourceEnv) (ManifestSource, error) {
+	if env == nil {
+		env = &SourceEnv{}
+	}
+	sourcesLock.RLock()
+	registration, ok := sources[spec.Type]
+	sourcesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("source %d has unknown type: %q", i, spec.Type)
+	}
+	if helm.Line != "" && !registration.traits.Versioned {
+		return nil, fmt.Errorf("source %d of type %q doesn't support release lines", i, spec.Type)
+	}
+	block := spec.Blocks[string(spec.Type)]
+	if block == nil {
+		return nil, fmt.Errorf("source %d has type '%s' but no '%s' block", i, spec.Type, spec.Type)
+	}
+	source, err := registration.create(block, release, helm, env)
+	if err != nil {
+		return nil, fmt.Errorf("source %d of type %q: %w", i, spec.Type, err)
+	}
+	return source, nil
+}
+
+// decodeBlock decodes the raw config block the same way koanf unmarshals the config
+func decodeBlock(block any, cfg any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.TextUnmarshallerHookFunc()),
+		WeaklyTypedInput: true,
+		TagName:          "koanf",
+		Result:           cfg,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(block); err != nil {
+		return fmt.Errorf("invalid config block: %w", err)
+	}
+	return nil
+}
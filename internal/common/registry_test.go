@@ -0,0 +1,165 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kyaml "github.com/knadh/koanf/parsers/yaml"
+	kfile "github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+)
+
+const testRegistryConfig = `
+sources:
+  - type: registryTest
+    helm:
+      chartName: operator
+    registryTest:
+      url: https://example.com/operator
+      timeout: 90s
+      paths:
+        - deploy/*.yaml
+      verify:
+        checksums: SHA256SUMS
+  - type: registryTest
+    helm:
+      chartName: no-block
+  - type: registryUnknown
+    helm:
+      chartName: unknown
+    registryUnknown:
+      url: https://example.com/unknown
+`
+
+const testRegistryType SourceType = "registryTest"
+
+type registryTestConfig struct {
+	Url     string        `koanf:"url"`
+	Timeout time.Duration `koanf:"timeout"`
+	Paths   []string      `koanf:"paths"`
+	Verify  *VerifyConfig `koanf:"verify"`
+}
+
+type registryTestSource struct {
+	cfg  *registryTestConfig
+	helm *HelmOps
+	env  *SourceEnv
+}
+
+func (s *registryTestSource) ChartName() string { return s.helm.ChartName }
+func (s *registryTestSource) HelmOps() *HelmOps { return s.helm }
+func (s *registryTestSource) Fetch(context.Context, string, string) (*Manifests, error) {
+	return nil, nil
+}
+
+func init() {
+	RegisterSource(testRegistryType, SourceTraits{},
+		func(cfg *registryTestConfig, _ *ReleasePolicy, helm *HelmOps, env *SourceEnv) (ManifestSource, error) {
+			return &registryTestSource{cfg: cfg, helm: helm, env: env}, nil
+		})
+}
+
+func TestNewSource(t *testing.T) {
+	//given
+	sources := loadTestSources(t)
+	env := &SourceEnv{Clients: map[SourceType]any{testRegistryType: "client"}}
+
+	//when
+	source, err := NewSource(0, &sources[0], &sources[0].Release, &sources[0].Helm, env)
+
+	//then
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+	created := source.(*registryTestSource)
+	if created.cfg.Url != "https://example.com/operator" || created.cfg.Timeout != 90*time.Second {
+		t.Errorf("NewSource() decoded url = %s, timeout = %s, want the block's values", created.cfg.Url, created.cfg.Timeout)
+	}
+	if len(created.cfg.Paths) != 1 || created.cfg.Verify == nil || created.cfg.Verify.Checksums != "SHA256SUMS" {
+		t.Errorf("NewSource() decoded paths = %v, verify = %+v, want the block's nested values", created.cfg.Paths, created.cfg.Verify)
+	}
+	if created.env != env || created.helm.ChartName != "operator" {
+		t.Errorf("NewSource() didn't pass the env and helm ops to the factory")
+	}
+}
+
+func TestNewSourceInvalid(t *testing.T) {
+	sources := loadTestSources(t)
+	tests := []struct {
+		name    string
+		index   int
+		helm    HelmOps
+		wantErr string
+	}{
+		{"missing block", 1, sources[1].Helm, "source 1 has type 'registryTest' but no 'registryTest' block"},
+		{"unknown type", 2, sources[2].Helm, `source 2 has unknown type: "registryUnknown"`},
+		{"release line of unversioned type", 0, HelmOps{ChartName: "operator", Line: "1.5"}, `source 0 of type "registryTest" doesn't support release lines`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			_, err := NewSource(tt.index, &sources[tt.index], &ReleasePolicy{}, &tt.helm, nil)
+
+			//then
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("NewSource() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSourceInvalidBlock(t *testing.T) {
+	//given
+	spec := SourceSpec{
+		Type:   testRegistryType,
+		Blocks: map[string]any{string(testRegistryType): map[string]any{"timeout": "soon"}},
+	}
+
+	//when
+	_, err := NewSource(3, &spec, &ReleasePolicy{}, &HelmOps{ChartName: "operator"}, nil)
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), `source 3 of type "registryTest": invalid config block`) {
+		t.Errorf("NewSource() error = %v, want invalid config block error", err)
+	}
+}
+
+func TestRegisterSourceTwice(t *testing.T) {
+	//given
+	defer func() {
+		//then
+		if r := recover(); r == nil || !strings.Contains(r.(string), "registered twice") {
+			t.Errorf("RegisterSource() recovered %v, want panic for type registered twice", r)
+		}
+	}()
+
+	//when
+	RegisterSource(testRegistryType, SourceTraits{},
+		func(cfg *registryTestConfig, _ *ReleasePolicy, helm *HelmOps, _ *SourceEnv) (ManifestSource, error) {
+			return nil, nil
+		})
+}
+
+// loadTestSources unmarshals the sources of testRegistryConfig like SetupConfig does
+func loadTestSources(t *testing.T) []SourceSpec {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(testRegistryConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k := koanf.NewWithConf(koanf.Conf{Delim: ".", StrictMerge: true})
+	if err := k.Load(kfile.Provider(file), kyaml.Parser()); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	var config struct {
+		Sources []SourceSpec `koanf:"sources"`
+	}
+	if err := k.Unmarshal("", &config); err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+	return config.Sources
+}
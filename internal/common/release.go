@@ -0,0 +1,120 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ReleasePolicy narrows down which upstream release a source follows.
+// Pin selects an exact tag. Otherwise the newest release matching the SemVer Constraint (e.g. "~1.6", ">=1.5 <2") is used,
+// prereleases are considered only when Prereleases is set.
+// StripTag is a regex removed from tags before SemVer parsing (e.g. "^release-").
+type ReleasePolicy struct {
+	Constraint  string `koanf:"constraint"`
+	Prereleases bool   `koanf:"prereleases"`
+	StripTag    string `koanf:"stripTag"`
+	Pin         string `koanf:"pin"`
+}
+
+// ReleaseLine is an additional upstream line maintained next to the one selected by the source's release policy,
+// e.g. Name "1.5" with Constraint "~1.5". Charts of the line are kept under <srcDir>/lines/<Name>.
+type ReleaseLine struct {
+	Name       string `koanf:"name"`
+	Constraint string `koanf:"constraint"`
+}
+
+// ForLine returns a copy of the policy narrowed to the line's constraint, pins don't apply to lines
+func (p *ReleasePolicy) ForLine(line *ReleaseLine) *ReleasePolicy {
+	policy := ReleasePolicy{}
+	if p != nil {
+		policy = *p
+	}
+	policy.Constraint = line.Constraint
+	policy.Pin = ""
+	return &policy
+}
+
+// FollowsLatest reports whether the policy accepts just the upstream's "latest" release
+func (p *ReleasePolicy) FollowsLatest() bool {
+	return p == nil || (p.Constraint == "" && !p.Prereleases && p.Pin == "")
+}
+
+// Normalize strips the StripTag regex from the tag
+func (p *ReleasePolicy) Normalize(tag string) (string, error) {
+	if p == nil || p.StripTag == "" {
+		return tag, nil
+	}
+	re, err := regexp.Compile(p.StripTag)
+	if err != nil {
+		return "", fmt.Errorf("invalid stripTag regex '%s': %w", p.StripTag, err)
+	}
+	return re.ReplaceAllString(tag, ""), nil
+}
+
+// Select returns the tag the policy settles on, tags that aren't valid SemVer (after normalization) are skipped
+func (p *ReleasePolicy) Select(tags []string) (string, error) {
+	if p != nil && p.Pin != "" {
+		for _, tag := range tags {
+			if tag == p.Pin {
+				return tag, nil
+			}
+		}
+		return "", fmt.Errorf("pinned tag %s not found", p.Pin)
+	}
+
+	matching, err := p.Filter(tags)
+	if err != nil {
+		return "", err
+	}
+	if len(matching) == 0 {
+		return "", fmt.Errorf("none of %d tags matches the release policy", len(tags))
+	}
+	return matching[len(matching)-1], nil
+}
+
+// Filter returns the tags matching the policy's constraint and prerelease setting ordered from the oldest, Pin is ignored
+func (p *ReleasePolicy) Filter(tags []string) ([]string, error) {
+	var constraint *semver.Constraints
+	if p != nil && p.Constraint != "" {
+		var err error
+		constraint, err = semver.NewConstraint(p.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint '%s': %w", p.Constraint, err)
+		}
+	}
+
+	versions := make(map[string]*semver.Version, len(tags))
+	matching := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		normalized, err := p.Normalize(tag)
+		if err != nil {
+			return nil, err
+		}
+		v, err := semver.NewVersion(normalized)
+		if err != nil {
+			continue
+		}
+		if v.Prerelease() != "" && (p == nil || !p.Prereleases) {
+			continue
+		}
+		if constraint != nil {
+			// check the release core, constraints otherwise reject all prereleases
+			core, _ := v.SetPrerelease("")
+			if !constraint.Check(&core) {
+				continue
+			}
+		}
+		if _, duplicate := versions[tag]; duplicate {
+			continue
+		}
+		versions[tag] = v
+		matching = append(matching, tag)
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return versions[matching[i]].LessThan(versions[matching[j]])
+	})
+	return matching, nil
+}
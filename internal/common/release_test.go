@@ -0,0 +1,148 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testTags = []string{"v1.4.2", "v1.5.0", "v1.5.1", "v1.6.0-rc.1", "v1.6.0-rc.0", "v1.5.3", "latest", "v2.0.0-alpha"}
+
+func TestReleasePolicySelect(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *ReleasePolicy
+		tags    []string
+		want    string
+		wantErr string
+	}{
+		{"no policy", nil, testTags, "v1.5.3", ""},
+		{"constraint", &ReleasePolicy{Constraint: "~1.5.0"}, testTags, "v1.5.3", ""},
+		{"constraint of older line", &ReleasePolicy{Constraint: "<1.5"}, testTags, "v1.4.2", ""},
+		{"prereleases", &ReleasePolicy{Prereleases: true}, testTags, "v2.0.0-alpha", ""},
+		{"prereleases within constraint", &ReleasePolicy{Constraint: "~1.6", Prereleases: true}, testTags, "v1.6.0-rc.1", ""},
+		{"stripped prefix", &ReleasePolicy{StripTag: "^release-"}, []string{"release-1.2.0", "release-1.10.0", "release-1.9.1"}, "release-1.10.0", ""},
+		{"pinned", &ReleasePolicy{Pin: "v1.5.0", Constraint: "~1.4"}, testTags, "v1.5.0", ""},
+		{"pinned missing tag", &ReleasePolicy{Pin: "v1.7.0"}, testTags, "", "pinned tag v1.7.0 not found"},
+		{"no match", &ReleasePolicy{Constraint: ">=3"}, testTags, "", "none of 8 tags matches"},
+		{"invalid constraint", &ReleasePolicy{Constraint: "~>one"}, testTags, "", "invalid version constraint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			tags := tt.tags
+
+			//when
+			tag, err := tt.policy.Select(tags)
+
+			//then
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Select() = %s, %v, want error containing %q", tag, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || tag != tt.want {
+				t.Errorf("Select() = %s, %v, want %s", tag, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleasePolicyFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *ReleasePolicy
+		tags   []string
+		want   []string
+	}{
+		{"ordered from oldest", nil, testTags, []string{"v1.4.2", "v1.5.0", "v1.5.1", "v1.5.3"}},
+		{"constraint", &ReleasePolicy{Constraint: ">=1.5 <1.6"}, testTags, []string{"v1.5.0", "v1.5.1", "v1.5.3"}},
+		{"prereleases", &ReleasePolicy{Constraint: "~1.6", Prereleases: true}, testTags, []string{"v1.6.0-rc.0", "v1.6.0-rc.1"}},
+		{"stripped prefix", &ReleasePolicy{StripTag: "^release-", Constraint: "<1.10"}, []string{"release-1.10.0", "release-1.9.1", "1.2.0", "release-foo"}, []string{"1.2.0", "release-1.9.1"}},
+		{"pin ignored", &ReleasePolicy{Pin: "v1.4.2", Constraint: "1.5.1"}, testTags, []string{"v1.5.1"}},
+		{"duplicates", nil, []string{"v1.0.0", "v1.0.0"}, []string{"v1.0.0"}},
+		{"no match", &ReleasePolicy{Constraint: ">=3"}, testTags, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			tags := tt.tags
+
+			//when
+			filtered, err := tt.policy.Filter(tags)
+
+			//then
+			if err != nil {
+				t.Fatalf("Filter() error = %v", err)
+			}
+			if fmt.Sprint(filtered) != fmt.Sprint(tt.want) {
+				t.Errorf("Filter() = %v, want %v", filtered, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleasePolicyNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *ReleasePolicy
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"no policy", nil, "v1.2.0", "v1.2.0", false},
+		{"nothing to strip", &ReleasePolicy{}, "release-1.2.0", "release-1.2.0", false},
+		{"stripped prefix", &ReleasePolicy{StripTag: "^release-"}, "release-1.2.0", "1.2.0", false},
+		{"stripped suffix", &ReleasePolicy{StripTag: "-ubi$"}, "v1.2.0-ubi", "v1.2.0", false},
+		{"prefix not matching", &ReleasePolicy{StripTag: "^release-"}, "v1.2.0", "v1.2.0", false},
+		{"invalid regex", &ReleasePolicy{StripTag: "(release"}, "release-1.2.0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			normalized, err := tt.policy.Normalize(tt.tag)
+
+			//then
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Normalize() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if normalized != tt.want {
+				t.Errorf("Normalize() = %s, want %s", normalized, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleasePolicyForLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *ReleasePolicy
+		want   ReleasePolicy
+	}{
+		{"no policy", nil, ReleasePolicy{Constraint: "~1.5"}},
+		{"keeps prereleases and stripTag", &ReleasePolicy{Constraint: ">=1.6", Prereleases: true, StripTag: "^release-"}, ReleasePolicy{Constraint: "~1.5", Prereleases: true, StripTag: "^release-"}},
+		{"drops pin", &ReleasePolicy{Pin: "v1.6.0"}, ReleasePolicy{Constraint: "~1.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			line := ReleaseLine{Name: "1.5", Constraint: "~1.5"}
+			var original ReleasePolicy
+			if tt.policy != nil {
+				original = *tt.policy
+			}
+
+			//when
+			policy := tt.policy.ForLine(&line)
+
+			//then
+			if *policy != tt.want {
+				t.Errorf("ForLine() = %+v, want %+v", *policy, tt.want)
+			}
+			if tt.policy != nil && *tt.policy != original {
+				t.Errorf("ForLine() modified the source policy to %+v", *tt.policy)
+			}
+		})
+	}
+}
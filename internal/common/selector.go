@@ -0,0 +1,57 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+// Selector matches Kubernetes resources, every set field must match the resource.
+// Fields are regular expressions like Modification.Kind, the core API group is matched with Group "^$"
+type Selector struct {
+	ApiVersion  string            `koanf:"apiVersion"`  // e.g. "apps/v1"
+	Group       string            `koanf:"group"`       // API group of the apiVersion, e.g. "rbac.authorization.k8s.io"
+	Kind        string            `koanf:"kind"`        // e.g. "^ConfigMap$"
+	Name        string            `koanf:"name"`        // metadata.name
+	Namespace   string            `koanf:"namespace"`   // metadata.namespace
+	Labels      map[string]string `koanf:"labels"`      // label name to the regex of its value, the label must be present
+	Annotations map[string]string `koanf:"annotations"` // annotation name to the regex of its value, the annotation must be present
+}
+
+// Matches tells whether the manifest is selected
+func (s *Selector) Matches(manifest *yqlib.CandidateNode) (bool, error) {
+	apiVersion := FieldValue(manifest, "apiVersion")
+	group := ""
+	if g, _, found := strings.Cut(apiVersion, "/"); found {
+		group = g
+	}
+
+	fields := []struct{ expr, value string }{
+		{s.ApiVersion, apiVersion},
+		{s.Group, group},
+		{s.Kind, ManifestKind(manifest)},
+		{s.Name, FieldValue(manifest, "metadata", "name")},
+		{s.Namespace, FieldValue(manifest, "metadata", "namespace")},
+	}
+	for _, field := range fields {
+		if field.expr == "" {
+			continue
+		}
+		if matches, err := Matches(field.expr, field.value); err != nil || !matches {
+			return false, err
+		}
+	}
+
+	for selectorField, selected := range map[string]map[string]string{"labels": s.Labels, "annotations": s.Annotations} {
+		for key, expr := range selected {
+			value := Field(manifest, "metadata", selectorField, key)
+			if value == nil || value.Kind != yqlib.ScalarNode {
+				return false, nil
+			}
+			if matches, err := Matches(expr, value.Value); err != nil || !matches {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
@@ -1,22 +1,20 @@
 package common
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"regexp"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	kyaml "github.com/knadh/koanf/parsers/yaml"
 	kfile "github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
-	"gopkg.in/yaml.v3"
 
 	glog "gopkg.in/op/go-logging.v1"
 )
@@ -49,10 +47,16 @@ func SetupConfig() (*Config, error) {
 		fmt.Println(f.FlagUsages())
 		os.Exit(0)
 	}
-	f.String("mode", "", "update|publish mode (overrides yaml file)")
-	f.Bool("offline", false, "skip git operations, useful for development")
+	f.String("mode", "", "update|publish|backfill mode (overrides yaml file)")
+	f.Bool("offline", false, "skip git operations, useful for development, with cache.dir upstream content is read from the cache only")
+	f.String("cache.dir", "", "directory of the upstream downloads cache (overrides yaml file)")
 	f.String("log.level", "", "log level (overrides yaml file)")
 	f.String("pr.authToken", "", "user token for auth")
+	f.String("github.authToken", "", "GitHub token for API reads")
+	f.String("github.apiUrl", "", "GitHub Enterprise API URL (overrides yaml file)")
+	f.String("backfill.chart", "", "chart to backfill (overrides yaml file)")
+	f.String("backfill.versions", "", "SemVer range of upstream releases to backfill (overrides yaml file)")
+	f.Bool("backfill.publish", false, "publish backfilled charts")
 	if err := f.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("error parsing flags: %v", err)
 	}
@@ -81,15 +85,18 @@ func SetupConfig() (*Config, error) {
 		log.Fatalf("error unmarshalling config: %v", err)
 	}
 
-	// Fallback: if pr.authToken still empty, use GITHUB_TOKEN env
-	if config.PullRequest.AuthToken == "" {
-		if envTok := os.Getenv("GITHUB_TOKEN"); envTok != "" {
+	// Fallback: if pr.authToken or github.authToken still empty, use GITHUB_TOKEN env
+	if envTok := os.Getenv("GITHUB_TOKEN"); envTok != "" {
+		if config.PullRequest.AuthToken == "" {
 			config.PullRequest.AuthToken = envTok
 		}
+		if config.Github.AuthToken == "" {
+			config.Github.AuthToken = envTok
+		}
 	}
 
 	if config.ModeOfOperation == "" {
-		log.Fatalf("No operation specified, use --mode=publish or --mode=update")
+		log.Fatalf("No operation specified, use --mode=publish, --mode=update or --mode=backfill")
 	}
 
 	return &config, nil
@@ -119,26 +126,23 @@ func DeepMerge(first *map[string]any, second *map[string]any) *map[string]any {
 	return &out
 }
 
-func ExtractYamls(assetData []byte) (*[]map[string]any, error) {
-	reader := bytes.NewReader(assetData)
-	decoder := yaml.NewDecoder(reader)
-
-	var documents []map[string]any
-	for {
-		var doc map[string]any
-		err := decoder.Decode(&doc)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			Log.Errorf("Failed to decode YAML document for asset: %v", err)
-			return nil, err
+// TakeNewerVersion picks the Chart version for a remote release: the remote version when it is valid SemVer
+// and not older than the existing one, the existing version otherwise.
+func TakeNewerVersion(existingVersion, remoteVersion string) (*semver.Version, error) {
+	semverExisting, _ := semver.NewVersion(existingVersion)
+	semverRemote, err := semver.NewVersion(remoteVersion)
+	if err != nil {
+		if semverExisting == nil {
+			return nil, fmt.Errorf("neither existing version %q nor remote version %q are valid SemVer", existingVersion, remoteVersion)
 		}
-		documents = append(documents, doc)
+		Log.Warnf("Remote version %s is not valid SemVer: %v, will use existing Chart's version: %s", remoteVersion, err, existingVersion)
+		return semverExisting, nil
 	}
 
-	Log.Infof("Successfully unmarshalled %d documents", len(documents))
-	return &documents, nil
+	if semverExisting != nil && semverRemote.Compare(semverExisting) < 0 {
+		return semverExisting, nil
+	}
+	return semverRemote, nil
 }
 
 func fileExists(path string) bool {
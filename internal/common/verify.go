@@ -0,0 +1,260 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/blake2b"
+)
+
+// SignatureType selects the format of the detached signature and its public key.
+type SignatureType string
+
+const (
+	SignaturePgp      SignatureType = "pgp"
+	SignatureMinisign SignatureType = "minisign"
+	SignatureCosign   SignatureType = "cosign"
+)
+
+// VerifyConfig enables provenance checks of the downloaded release assets.
+// Checksums names the checksums file published in the same release (e.g. "SHA256SUMS", SHA-256 or SHA-512 sums
+// in the GNU or BSD format), every downloaded asset must be listed in it.
+// Signature names the detached signature of the checksums file (e.g. "SHA256SUMS.asc"), verified with the
+// PublicKey (armored PGP key, minisign public key, or PEM public key for cosign) according to SignatureType.
+type VerifyConfig struct {
+	Checksums     string        `koanf:"checksums"`
+	Signature     string        `koanf:"signature"`
+	SignatureType SignatureType `koanf:"signatureType"`
+	PublicKey     string        `koanf:"publicKey"`
+}
+
+var bsdChecksumLine = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// Validate rejects incomplete verification settings, which would otherwise skip the checks silently
+func (v *VerifyConfig) Validate() error {
+	if v == nil {
+		return nil
+	}
+	if v.Checksums == "" {
+		return fmt.Errorf("verification requires the checksums file")
+	}
+	if v.Signature == "" {
+		if v.PublicKey != "" || v.SignatureType != "" {
+			return fmt.Errorf("publicKey and signatureType require the signature file of %s", v.Checksums)
+		}
+		return nil
+	}
+	if v.PublicKey == "" {
+		return fmt.Errorf("signature %s requires the publicKey", v.Signature)
+	}
+	switch v.SignatureType {
+	case SignaturePgp, SignatureMinisign, SignatureCosign:
+		return nil
+	default:
+		return fmt.Errorf("unsupported signature type: %q", v.SignatureType)
+	}
+}
+
+// VerifyAssets checks the assets against the release's checksums file (and its signature),
+// download fetches the named verification file from the same release.
+func (v *VerifyConfig) VerifyAssets(assets map[string][]byte, download func(name string) ([]byte, error)) error {
+	if v == nil {
+		return nil
+	}
+	if err := v.Validate(); err != nil {
+		return err
+	}
+
+	checksums, err := download(v.Checksums)
+	if err != nil {
+		return fmt.Errorf("failed to download checksums file %s: %w", v.Checksums, err)
+	}
+	if v.Signature != "" {
+		signature, err := download(v.Signature)
+		if err != nil {
+			return fmt.Errorf("failed to download signature %s: %w", v.Signature, err)
+		}
+		if err := VerifySignature(v.SignatureType, v.PublicKey, checksums, signature); err != nil {
+			return fmt.Errorf("signature %s of %s is invalid: %w", v.Signature, v.Checksums, err)
+		}
+		Log.Infof("Verified %s signature of %s", v.SignatureType, v.Checksums)
+	}
+
+	sums, err := parseChecksums(checksums)
+	if err != nil {
+		return fmt.Errorf("failed to parse checksums file %s: %w", v.Checksums, err)
+	}
+	for name, data := range assets {
+		expected, ok := sums[name]
+		if !ok {
+			return fmt.Errorf("asset %s is not listed in %s", name, v.Checksums)
+		}
+		var h hash.Hash
+		switch len(expected) {
+		case sha256.Size * 2:
+			h = sha256.New()
+		case sha512.Size * 2:
+			h = sha512.New()
+		default:
+			return fmt.Errorf("unsupported checksum of %s in %s", name, v.Checksums)
+		}
+		h.Write(data)
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("checksum mismatch of asset %s: expected %s, got %s", name, expected, actual)
+		}
+		Log.Infof("Verified checksum of asset %s", name)
+	}
+	return nil
+}
+
+// parseChecksums reads "<hex>  <name>", "<hex> *<name>" and "SHA256 (<name>) = <hex>" lines, keyed by the full file name
+func parseChecksums(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+			sums[match[2]] = strings.ToLower(match[3])
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+		name := strings.TrimPrefix(fields[1], "*")
+		sums[name] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+// VerifySignature checks the detached signature of data with the public key
+func VerifySignature(signatureType SignatureType, publicKey string, data, signature []byte) error {
+	if publicKey == "" {
+		return fmt.Errorf("no public key configured")
+	}
+	switch signatureType {
+	case SignaturePgp:
+		return verifyPgp(publicKey, data, signature)
+	case SignatureMinisign:
+		return verifyMinisign(publicKey, data, signature)
+	case SignatureCosign:
+		return verifyCosign(publicKey, data, signature)
+	default:
+		return fmt.Errorf("unsupported signature type: %q", signatureType)
+	}
+}
+
+func verifyPgp(publicKey string, data, signature []byte) error {
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		return fmt.Errorf("invalid PGP public key: %w", err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(data), bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyRing, bytes.NewReader(data), bytes.NewReader(signature), nil)
+	}
+	return err
+}
+
+// verifyMinisign checks both the signature of data and the global signature of the trusted comment
+func verifyMinisign(publicKey string, data, signature []byte) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(lastLine(publicKey))
+	if err != nil || len(keyBytes) != 2+8+ed25519.PublicKeySize || string(keyBytes[:2]) != "Ed" {
+		return fmt.Errorf("invalid minisign public key")
+	}
+	keyId, key := keyBytes[2:10], ed25519.PublicKey(keyBytes[10:])
+
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigBytes) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	if !bytes.Equal(sigBytes[2:10], keyId) {
+		return fmt.Errorf("minisign signature was made with a different key")
+	}
+	message := data
+	switch string(sigBytes[:2]) {
+	case "Ed":
+	case "ED":
+		prehashed := blake2b.Sum512(data)
+		message = prehashed[:]
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm")
+	}
+	sig := sigBytes[10:]
+	if !ed25519.Verify(key, message, sig) {
+		return fmt.Errorf("minisign signature mismatch")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign global signature")
+	}
+	trustedComment := strings.TrimSuffix(strings.TrimPrefix(lines[2], "trusted comment: "), "\r")
+	if !ed25519.Verify(key, append(bytes.Clone(sig), trustedComment...), globalSig) {
+		return fmt.Errorf("minisign trusted comment signature mismatch")
+	}
+	return nil
+}
+
+// verifyCosign checks the base64 signature produced by `cosign sign-blob --key`
+func verifyCosign(publicKey string, data, signature []byte) error {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return fmt.Errorf("invalid PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	digest := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// lastLine skips the "untrusted comment:" line of minisign keys
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
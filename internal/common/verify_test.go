@@ -0,0 +1,202 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"golang.org/x/crypto/blake2b"
+)
+
+const testOperator = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+`
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestVerifyAssets(t *testing.T) {
+	sums := fmt.Sprintf("%x  operator.yaml\n", sha256.Sum256([]byte(testOperator)))
+	signers := map[SignatureType]func(t *testing.T, data []byte) (string, []byte){
+		SignatureCosign:   signCosign,
+		SignatureMinisign: signMinisign,
+		SignaturePgp:      signPgp,
+	}
+	tests := []struct {
+		name     string
+		operator string
+		signed   string
+		wantErr  string
+	}{
+		{"genuine", testOperator, sums, ""},
+		{"tampered asset", testOperator + "  namespace: evil\n", sums, "checksum mismatch"},
+		{"tampered checksums", testOperator, strings.Replace(sums, "operator.yaml", "other.yaml", 1), "signature"},
+	}
+	for signatureType, sign := range signers {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s %s", signatureType, tt.name), func(t *testing.T) {
+				//given
+				publicKey, signature := sign(t, []byte(tt.signed))
+				verify := VerifyConfig{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig", SignatureType: signatureType, PublicKey: publicKey}
+				files := map[string][]byte{"SHA256SUMS": []byte(sums), "SHA256SUMS.sig": signature}
+
+				//when
+				err := verify.VerifyAssets(map[string][]byte{"operator.yaml": []byte(tt.operator)}, func(name string) ([]byte, error) {
+					return files[name], nil
+				})
+
+				//then
+				if tt.wantErr == "" && err != nil {
+					t.Errorf("VerifyAssets() error = %v", err)
+				}
+				if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Errorf("VerifyAssets() error = %v, want error containing %q", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAssetsFullName(t *testing.T) {
+	//given
+	sums := fmt.Sprintf("%x  dist/operator.yaml\n", sha256.Sum256([]byte(testOperator)))
+	verify := VerifyConfig{Checksums: "SHA256SUMS"}
+
+	//when
+	err := verify.VerifyAssets(map[string][]byte{"operator.yaml": []byte(testOperator)}, func(name string) ([]byte, error) {
+		return []byte(sums), nil
+	})
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("VerifyAssets() error = %v, want the asset not listed under its full name", err)
+	}
+}
+
+func TestVerifyConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		verify  *VerifyConfig
+		wantErr bool
+	}{
+		{"not configured", nil, false},
+		{"checksums only", &VerifyConfig{Checksums: "SHA256SUMS"}, false},
+		{"signed checksums", &VerifyConfig{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig", SignatureType: SignatureCosign, PublicKey: "key"}, false},
+		{"no checksums", &VerifyConfig{Signature: "SHA256SUMS.sig", SignatureType: SignatureCosign, PublicKey: "key"}, true},
+		{"empty block", &VerifyConfig{}, true},
+		{"public key without signature", &VerifyConfig{Checksums: "SHA256SUMS", PublicKey: "key"}, true},
+		{"signature type without signature", &VerifyConfig{Checksums: "SHA256SUMS", SignatureType: SignaturePgp}, true},
+		{"signature without public key", &VerifyConfig{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig", SignatureType: SignaturePgp}, true},
+		{"unknown signature type", &VerifyConfig{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig", SignatureType: "gpg", PublicKey: "key"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.verify.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	//given
+	data := `# generated
+3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  operator.yaml
+5ca2aa845c8cd5ac1f8b1b2c9e1c1f4a8a2f6e1b3d1c6d2e9f0a1b2c3d4e5f60 *crds.tar.gz
+
+SHA256 (dist/bundle.yaml) = 7E4F36A2A3F1C1D0E9B8A7F6E5D4C3B2A1F0E9D8C7B6A5F4E3D2C1B0A9F8E7D6
+`
+
+	//when
+	sums, err := parseChecksums([]byte(data))
+
+	//then
+	if err != nil {
+		t.Fatalf("parseChecksums() error = %v", err)
+	}
+	expected := map[string]string{
+		"operator.yaml":    "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+		"crds.tar.gz":      "5ca2aa845c8cd5ac1f8b1b2c9e1c1f4a8a2f6e1b3d1c6d2e9f0a1b2c3d4e5f60",
+		"dist/bundle.yaml": "7e4f36a2a3f1c1d0e9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6",
+	}
+	if fmt.Sprint(sums) != fmt.Sprint(expected) {
+		t.Errorf("parseChecksums() = %v, want %v", sums, expected)
+	}
+	if _, err := parseChecksums([]byte("3a6eb079 two names here\n")); err == nil {
+		t.Errorf("parseChecksums() expected error for malformed line")
+	}
+}
+
+// signCosign signs data like `cosign sign-blob --key`, returns the PEM public key and the base64 signature
+func signCosign(t *testing.T, data []byte) (string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	digest := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})), []byte(base64.StdEncoding.EncodeToString(signature))
+}
+
+// signMinisign signs the prehashed data like `minisign -S`, returns the public key file and the signature file
+func signMinisign(t *testing.T, data []byte) (string, []byte) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyId := []byte("charter1")
+	prehashed := blake2b.Sum512(data)
+	signature := ed25519.Sign(privateKey, prehashed[:])
+	trustedComment := "timestamp:1700000000\tfile:SHA256SUMS\thashed"
+	globalSignature := ed25519.Sign(privateKey, append(bytes.Clone(signature), trustedComment...))
+
+	publicKeyFile := "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyId...), publicKey...))
+	signatureFile := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyId...), signature...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSignature))
+	return publicKeyFile, []byte(signatureFile)
+}
+
+// signPgp signs data like `gpg --armor --detach-sign`, returns the armored public key and the armored signature
+func signPgp(t *testing.T, data []byte) (string, []byte) {
+	entity, err := openpgp.NewEntity("charter", "test", "charter@example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var publicKey bytes.Buffer
+	writer, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("failed to armor public key: %v", err)
+	}
+	if err := entity.Serialize(writer); err != nil {
+		t.Fatalf("failed to serialize public key: %v", err)
+	}
+	_ = writer.Close()
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return publicKey.String(), signature.Bytes()
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/kiemlicz/charter/internal/common"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
 	"gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
@@ -21,13 +22,30 @@ import (
 	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
-var ErrVersionExists = errors.New("chart version already exists in registry")
+var (
+	ErrVersionExists = errors.New("chart version already exists in registry")
+	// autoIndentRegex matches the indentation of templated blocks to be computed from their position, e.g. "nindent AUTO"
+	autoIndentRegex = regexp.MustCompile(`\b(n?indent)\s+` + AutoIndent + `\b`)
+)
+
+const (
+	// AutoIndent is the placeholder of the (n)indent argument resolved to the indentation of the templated block
+	AutoIndent = "AUTO"
+	// yamlIndent is the indentation of the YAML marshalled by yaml.v3, which renders the templates
+	yamlIndent = 4
+	// placeholderFormat is the token standing for a templated scalar until the manifest is serialized
+	placeholderFormat = "__charter_template_%d__"
+)
 
 // HelmizedManifests holds the Helm chart and its path created from Kubernetes manifests.
+// Line names the release line the charts belong to, empty for the main line.
+// Umbrellas are the umbrella charts updated along with the charts, stored in the same Path.
 type HelmizedManifests struct {
-	Path     string
-	Chart    *chart.Chart
-	CrdChart *chart.Chart
+	Path      string
+	Line      string
+	Chart     *chart.Chart
+	CrdChart  *chart.Chart
+	Umbrellas []*chart.Chart
 }
 
 func (packaged *HelmizedManifests) AppVersion() string {
@@ -239,7 +257,9 @@ func clearTemplates(path string) error {
 
 // FetchAndUpdate checks for a newer upstream version via the given ManifestSource,
 // then builds and saves the Helm chart(s). Returns nil when already up to date.
+// Charts of additional release lines are read from and saved to the line's storage.
 func FetchAndUpdate(ctx context.Context, source common.ManifestSource, settings *common.HelmSettings) (*HelmizedManifests, error) {
+	settings = settings.ForLine(source.HelmOps().Line)
 	chartName := source.ChartName()
 	common.Log.Infof("Checking for updates: %s", chartName)
 	currentVersion, currentAppVersion, err := PeekVersions(settings.SrcDir, chartName)
@@ -264,13 +284,16 @@ func FetchAndUpdate(ctx context.Context, source common.ManifestSource, settings
 // inserting helpers using textRegex clauses
 func Prepare(manifests *common.Manifests, helmOps *common.HelmOps, settings *common.HelmSettings) (*HelmizedManifests, error) {
 	common.Log.Infof("Creating or updating Helm chart %s with %d manifests", helmOps.ChartName, len(manifests.Manifests))
-	modifiedManifests, err := ChartModifier.ParametrizeManifests(
-		ChartModifier.FilterManifests(
-			manifests,
-			helmOps.Drop,
-		),
-		&helmOps.Modifications,
-	)
+	filteredManifests, err := ChartModifier.FilterManifests(manifests, helmOps.Drop, helmOps.DropSelectors)
+	if err != nil {
+		return nil, err
+	}
+	// resources are selected before modifications, which may template their names
+	conditions, toggles, err := optionalConditions(filteredManifests.Manifests, helmOps.Optional)
+	if err != nil {
+		return nil, err
+	}
+	modifiedManifests, err := ChartModifier.ParametrizeManifests(helmOps.ChartName, filteredManifests, &helmOps.Modifications)
 	if err != nil {
 		return nil, err
 	}
@@ -283,7 +306,7 @@ func Prepare(manifests *common.Manifests, helmOps *common.HelmOps, settings *com
 	if modifiedManifests.ContainsCrds() {
 		crdsChartName := fmt.Sprintf("%s-crds", helmOps.ChartName)
 		common.Log.Infof("Moving %d CRDs to dedicated chart %s", len(modifiedManifests.Crds), crdsChartName)
-		templates, err := createTemplates(&modifiedManifests.Crds, &helmOps.Modifications)
+		templates, err := createTemplates(&modifiedManifests.Crds, nil, &helmOps.Modifications)
 		if err != nil {
 			return nil, err
 		}
@@ -301,8 +324,8 @@ func Prepare(manifests *common.Manifests, helmOps *common.HelmOps, settings *com
 			}
 		}
 	}
-	values := modifiedManifests.Values
-	templates, err := createTemplates(&modifiedManifests.Manifests, &helmOps.Modifications)
+	values := *common.DeepMerge(&toggles, &modifiedManifests.Values)
+	templates, err := createTemplates(&modifiedManifests.Manifests, conditions, &helmOps.Modifications)
 	common.Log.Infof("Created %d templates for main chart", len(templates))
 	if err != nil {
 		return nil, err
@@ -326,6 +349,7 @@ func Prepare(manifests *common.Manifests, helmOps *common.HelmOps, settings *com
 
 	createdChart := &HelmizedManifests{
 		Path:     settings.SrcDir,
+		Line:     helmOps.Line,
 		Chart:    mainChart,
 		CrdChart: crdsChart,
 	}
@@ -333,8 +357,46 @@ func Prepare(manifests *common.Manifests, helmOps *common.HelmOps, settings *com
 	return createdChart, nil
 }
 
-func createTemplates(manifests *[]map[string]any, modification *[]common.Modification) ([]*chart.File, error) {
-	kindToFile, err := materializeManifests(manifests)
+// optionalConditions returns the values key of the toggle of every manifest (empty for the mandatory ones)
+// and the values with the toggles' defaults
+func optionalConditions(manifests []*yqlib.CandidateNode, optional []common.Optional) ([]string, map[string]any, error) {
+	conditions := make([]string, len(manifests))
+	toggles := make(map[string]any)
+	for _, o := range optional {
+		if !valuesKeyRegex.MatchString(o.ValuesKey) {
+			return nil, nil, fmt.Errorf("optional resources have invalid valuesKey '%s'", o.ValuesKey)
+		}
+		selected := 0
+		for i, manifest := range manifests {
+			if conditions[i] != "" {
+				continue // the first matching toggle applies
+			}
+			matches, err := o.Selector.Matches(manifest)
+			if err != nil {
+				return nil, nil, err
+			}
+			if matches {
+				conditions[i] = o.ValuesKey
+				selected++
+			}
+		}
+		if selected == 0 {
+			common.Log.Warnf("No resources selected by optional resources toggled with %s", o.ValuesKey)
+			continue
+		}
+		common.Log.Debugf("%d resources toggled with %s.enabled", selected, o.ValuesKey)
+		toggle := map[string]any{"enabled": !o.Disabled}
+		keys := strings.Split(o.ValuesKey, ".")
+		for i := len(keys) - 1; i > 0; i-- {
+			toggle = map[string]any{keys[i]: toggle}
+		}
+		toggles = *common.DeepMerge(&toggles, &map[string]any{keys[0]: toggle})
+	}
+	return conditions, toggles, nil
+}
+
+func createTemplates(manifests *[]*yqlib.CandidateNode, conditions []string, modification *[]common.Modification) ([]*chart.File, error) {
+	kindToFile, err := materializeManifests(manifests, conditions)
 	if err != nil {
 		return nil, err
 	}
@@ -343,6 +405,8 @@ func createTemplates(manifests *[]map[string]any, modification *[]common.Modific
 		if err != nil {
 			return nil, err
 		}
+		// after the textRegex modifications, these may use the AUTO indentation too
+		file.Data = resolveAutoIndent(file.Data)
 	}
 
 	templates := make([]*chart.File, 0, len(kindToFile))
@@ -353,6 +417,80 @@ func createTemplates(manifests *[]map[string]any, modification *[]common.Modific
 	return templates, nil
 }
 
+// withPlaceholders returns a copy of the manifest with the templated scalars swapped for opaque tokens,
+// the tokens serialize as plain scalars and are replaced with the raw templates afterwards, so no YAML quoting
+// or escaping ends up in the templates, whatever the templates contain (quotes, new lines or surrounding text)
+func withPlaceholders(manifest *yqlib.CandidateNode) (*yqlib.CandidateNode, *strings.Replacer) {
+	placeholders := make([]string, 0)
+	var tokenize func(node *yqlib.CandidateNode)
+	tokenize = func(node *yqlib.CandidateNode) {
+		if node.Kind == yqlib.ScalarNode && strings.Contains(node.Value, "{{") {
+			token := fmt.Sprintf(placeholderFormat, len(placeholders)/2)
+			placeholders = append(placeholders, token, node.Value)
+			node.Value = token
+			node.Style = 0
+		}
+		for _, child := range node.Content {
+			tokenize(child)
+		}
+	}
+	templated := manifest.Copy()
+	tokenize(templated)
+	return templated, strings.NewReplacer(placeholders...)
+}
+
+// resolveAutoIndent replaces the AUTO indentation of templates with the indentation of the block at the template's line
+func resolveAutoIndent(manifestYAML []byte) []byte {
+	if !autoIndentRegex.Match(manifestYAML) {
+		return manifestYAML
+	}
+	lines := strings.Split(string(manifestYAML), "\n")
+	for i, line := range lines {
+		if autoIndentRegex.MatchString(line) {
+			lines[i] = autoIndentRegex.ReplaceAllString(line, fmt.Sprintf("${1} %d", blockIndent(lines, i)))
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// blockIndent is the indentation of the block value of the key at the line, as marshalled by yaml.v3:
+// the content of a mapping is indented by yamlIndent, but a list item's mapping is indented from the item's dash.
+// Lines holding templates only (e.g. the following lines of a multi-line textRegex expression) continue the block of the key above
+func blockIndent(lines []string, i int) int {
+	if isTemplateLine(lines[i]) {
+		for j := i - 1; j >= 0; j-- {
+			if !isTemplateLine(lines[j]) {
+				return blockIndent(lines, j)
+			}
+		}
+	}
+	column := indentation(lines[i])
+	if strings.HasPrefix(lines[i][column:], "- ") {
+		return column + yamlIndent
+	}
+	for j := i - 1; j >= 0; j-- {
+		if trimmed := strings.TrimSpace(lines[j]); trimmed == "" || strings.HasPrefix(trimmed, "#") || isTemplateLine(lines[j]) {
+			continue
+		}
+		if parentColumn := indentation(lines[j]); parentColumn < column {
+			if strings.HasPrefix(lines[j][parentColumn:], "- ") && parentColumn+2 == column {
+				// sibling of the item's first key
+				return parentColumn + yamlIndent
+			}
+			break
+		}
+	}
+	return column + yamlIndent
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isTemplateLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "{{")
+}
+
 func insertHelpers(kind string, template *chart.File, mods *[]common.Modification) error {
 	content := string(template.Data)
 	for _, mod := range *mods {
@@ -377,6 +515,15 @@ func insertHelpers(kind string, template *chart.File, mods *[]common.Modificatio
 				continue
 			}
 		}
+		if mod.Selector != nil && mod.Selector.Kind != "" {
+			kindMatches, err := common.Matches(mod.Selector.Kind, kind)
+			if err != nil {
+				return err
+			}
+			if !kindMatches {
+				continue
+			}
+		}
 		textRegex := regexp.MustCompile(mod.TextRegex)
 		content = textRegex.ReplaceAllString(content, mod.Expression)
 	}
@@ -391,6 +538,10 @@ func newHelmChart(chartData *common.ChartData, helmSettings *common.HelmSettings
 	vals := chartData.Values
 	templates := chartData.Templates
 
+	if err := os.MkdirAll(helmSettings.SrcDir, 0755); err != nil {
+		common.Log.Errorf("Failed to create charts directory %s: %v", helmSettings.SrcDir, err)
+		return nil, err
+	}
 	chartPath, err := chartutil.Create(chartName, helmSettings.SrcDir) //overwrites
 	if err != nil {
 		common.Log.Errorf("Failed to create Helm chart in %s: %v", helmSettings.SrcDir, err)
@@ -424,8 +575,13 @@ func newHelmChart(chartData *common.ChartData, helmSettings *common.HelmSettings
 	return chartObj, nil
 }
 
+// PeekVersions returns the version and appVersion of the existing chart, empty ones when the chart doesn't exist yet
 func PeekVersions(chartDir, chartName string) (string, string, error) {
 	path := fmt.Sprintf("%s/%s", chartDir, chartName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		common.Log.Infof("Helm chart %s doesn't exist yet, will create it", path)
+		return "", "", nil
+	}
 	chartObj, err := loader.Load(path)
 	if err != nil {
 		common.Log.Errorf("Failed to load Helm chart from %s: %v", path, err)
@@ -434,22 +590,24 @@ func PeekVersions(chartDir, chartName string) (string, string, error) {
 	return chartObj.Metadata.Version, chartObj.AppVersion(), nil
 }
 
-func materializeManifests(newManifests *[]map[string]any) (map[string]*chart.File, error) {
+// materializeManifests renders the manifests to templates, grouped by kind,
+// manifests with a non-empty condition are rendered only when .Values.<condition>.enabled
+func materializeManifests(newManifests *[]*yqlib.CandidateNode, conditions []string) (map[string]*chart.File, error) {
 	templates := make(map[string]*chart.File, len(*newManifests))
-	re := regexp.MustCompile(`'(\{\{.*?\}\})'|"(\{\{.*?\}\})"`)
 
 	for i, manifest := range *newManifests {
-		manifestYAML, err := yaml.Marshal(manifest)
+		templated, placeholders := withPlaceholders(manifest)
+		manifestYAML, err := ChartModifier.encode(templated)
 		if err != nil {
 			common.Log.Errorf("Failed to marshal manifest %d: %v", i, err)
 			return nil, err
 		}
-		manifestYAML = re.ReplaceAllFunc(manifestYAML, func(match []byte) []byte {
-			// Remove the surrounding quotes that break the Helm template syntax
-			return match[1 : len(match)-1]
-		})
-		kind, ok := manifest[common.Kind].(string)
-		if !ok {
+		manifestYAML = []byte(placeholders.Replace(string(manifestYAML)))
+		if i < len(conditions) && conditions[i] != "" {
+			manifestYAML = fmt.Appendf(nil, "{{- if .Values.%s.enabled }}\n%s{{- end }}\n", conditions[i], manifestYAML)
+		}
+		kind := common.ManifestKind(manifest)
+		if kind == "" {
 			common.Log.Errorf("Broken manifest: %s", string(manifestYAML))
 			return nil, fmt.Errorf("manifest %d does not have a valid 'kind' field", i)
 		}
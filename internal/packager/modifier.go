@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
-	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/kiemlicz/charter/internal/common"
@@ -13,88 +13,121 @@ import (
 )
 
 var (
-	ChartModifier = newModifier()
+	ChartModifier  = newModifier()
+	valuesKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
 )
 
 type modifier struct {
-	encoder   yqlib.Encoder
-	decoder   yqlib.Decoder
-	evaluator yqlib.Evaluator
+	encoder         yqlib.Encoder
+	manifestEncoder yqlib.Encoder
+	evaluator       yqlib.Evaluator
 }
 
 func newModifier() *modifier {
-	encoder := yqlib.NewYamlEncoder(yqlib.NewDefaultYamlPreferences())
-	decoder := yqlib.NewYamlDecoder(yqlib.NewDefaultYamlPreferences())
+	encoderPreferences := yqlib.NewDefaultYamlPreferences()
+	encoderPreferences.UnwrapScalar = false // keeps quotes of strings like "true", so these are extracted to values as strings
+	encoder := yqlib.NewYamlEncoder(encoderPreferences)
+	manifestPreferences := yqlib.NewDefaultYamlPreferences()
+	manifestPreferences.Indent = yamlIndent
+	manifestPreferences.PrintDocSeparators = false
+	manifestEncoder := yqlib.NewYamlEncoder(manifestPreferences)
 	evaluator := yqlib.NewAllAtOnceEvaluator()
 
 	return &modifier{
-		encoder:   encoder,
-		decoder:   decoder,
-		evaluator: evaluator,
+		encoder:         encoder,
+		manifestEncoder: manifestEncoder,
+		evaluator:       evaluator,
 	}
 }
 
-func (m *modifier) decode(yamlBytes *[]byte) (*yqlib.CandidateNode, error) {
-	err := m.decoder.Init(bytes.NewReader(*yamlBytes))
-	if err != nil {
-		common.Log.Errorf("Failed to initialize decoder for manifest: %v", err)
-		return nil, err
-	}
-	candidNode, err := m.decoder.Decode()
-	if err != nil {
-		common.Log.Errorf("Failed to decode manifest to yaml node: %v", err)
+// encode marshals the manifest to YAML, the only serialization of manifests in the pipeline besides the change detection
+func (m *modifier) encode(manifest *yqlib.CandidateNode) ([]byte, error) {
+	out := new(bytes.Buffer)
+	if err := m.manifestEncoder.Encode(out, manifest); err != nil {
 		return nil, err
 	}
-	return candidNode, nil
+	return out.Bytes(), nil
 }
 
-func (m *modifier) FilterManifests(manifests *common.Manifests, denyKindFilter []string) *common.Manifests {
-	filteredManifests := make([]map[string]any, 0)
+// FilterManifests drops the manifests of the denied kinds and the manifests and CRDs matching any of the denied selectors
+func (m *modifier) FilterManifests(manifests *common.Manifests, denyKindFilter []string, denySelectors []common.Selector) (*common.Manifests, error) {
 	deniedKinds := make(map[string]bool)
 	for _, filter := range denyKindFilter {
 		deniedKinds[strings.ToLower(filter)] = true
 	}
 
-	for _, m := range (*manifests).Manifests {
-		if kind, ok := m[common.Kind].(string); ok && deniedKinds[strings.ToLower(kind)] {
-			continue
-		}
-		filteredManifests = append(filteredManifests, m)
+	filteredManifests, err := filter(manifests.Manifests, deniedKinds, denySelectors)
+	if err != nil {
+		return nil, err
+	}
+	filteredCrds, err := filter(manifests.Crds, nil, denySelectors)
+	if err != nil {
+		return nil, err
 	}
 
 	return &common.Manifests{
-		Crds:       manifests.Crds,
+		Crds:       filteredCrds,
 		Manifests:  filteredManifests,
 		Version:    manifests.Version,
 		AppVersion: manifests.AppVersion,
 		Values:     manifests.Values,
 		CrdsValues: manifests.CrdsValues,
+	}, nil
+}
+
+func filter(manifests []*yqlib.CandidateNode, deniedKinds map[string]bool, denySelectors []common.Selector) ([]*yqlib.CandidateNode, error) {
+	filtered := make([]*yqlib.CandidateNode, 0, len(manifests))
+	for _, m := range manifests {
+		if deniedKinds[strings.ToLower(common.ManifestKind(m))] {
+			continue
+		}
+		denied, err := selected(m, denySelectors)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			common.Log.Debugf("Dropping %s %s due to drop selector", common.ManifestKind(m), common.FieldValue(m, "metadata", "name"))
+			continue
+		}
+		filtered = append(filtered, m)
 	}
+	return filtered, nil
 }
 
-// ParametrizeManifests applies modifications to manifests
+// selected tells whether any of the selectors matches the manifest
+func selected(manifest *yqlib.CandidateNode, selectors []common.Selector) (bool, error) {
+	for _, selector := range selectors {
+		matches, err := selector.Matches(manifest)
+		if err != nil || matches {
+			return matches, err
+		}
+	}
+	return false, nil
+}
+
+// ParametrizeManifests applies modifications to copies of the manifests of the chart
 // returns modified manifests and extracted values
-func (m *modifier) ParametrizeManifests(manifests *common.Manifests, mods *[]common.Modification) (*common.Manifests, error) {
-	modifiedManifests := make([]map[string]any, 0)
-	modifiedCrds := make([]map[string]any, 0)
+func (m *modifier) ParametrizeManifests(chartName string, manifests *common.Manifests, mods *[]common.Modification) (*common.Manifests, error) {
+	modifiedManifests := make([]*yqlib.CandidateNode, 0)
+	modifiedCrds := make([]*yqlib.CandidateNode, 0)
 	extractedValues := manifests.Values
 	extractedCrdValues := manifests.CrdsValues
 
 	for _, manifest := range manifests.Manifests {
-		modifiedManifest, v, err := m.applyModifications(&manifest, mods)
+		modifiedManifest, v, err := m.applyModifications(chartName, manifest, mods)
 		if err != nil {
 			return nil, err //not continuing on error
 		}
-		modifiedManifests = append(modifiedManifests, *modifiedManifest)
+		modifiedManifests = append(modifiedManifests, modifiedManifest)
 		extractedValues = *common.DeepMerge(&extractedValues, v)
 	}
 
 	for _, crd := range manifests.Crds {
-		m, v, err := m.applyModifications(&crd, mods)
+		m, v, err := m.applyModifications(chartName, crd, mods)
 		if err != nil {
 			return nil, err //not continuing on error
 		}
-		modifiedCrds = append(modifiedCrds, *m)
+		modifiedCrds = append(modifiedCrds, m)
 		extractedCrdValues = *common.DeepMerge(&extractedCrdValues, v)
 	}
 
@@ -108,20 +141,14 @@ func (m *modifier) ParametrizeManifests(manifests *common.Manifests, mods *[]com
 	}, nil
 }
 
-func (m *modifier) applyModifications(manifest *map[string]any, mods *[]common.Modification) (*map[string]any, *map[string]any, error) {
-	common.Log.Debugf("Applying %d modifications to manifest of kind: %v", len(*mods), (*manifest)[common.Kind])
-	common.Log.Tracef("Original manifest:\n%+v", manifest)
+// applyModifications evaluates the modifications on a copy of the manifest, the targeting rules match the original manifest
+func (m *modifier) applyModifications(chartName string, manifest *yqlib.CandidateNode, mods *[]common.Modification) (*yqlib.CandidateNode, *map[string]any, error) {
+	kind := common.ManifestKind(manifest)
+	common.Log.Debugf("Applying %d modifications to manifest of kind: %s", len(*mods), kind)
 
-	modifiedManifest := *manifest
+	candidNode := manifest.Copy()
 	extractedValues := make(map[string]any)
 
-	yamlBytes, err := yaml.Marshal(manifest)
-	if err != nil {
-		common.Log.Errorf("Failed to marshal manifest to YAML during applying modifications: %v", err)
-		return nil, nil, err
-	}
-	candidNode, err := m.decode(&yamlBytes)
-
 	for _, mod := range *mods {
 		if mod.TextRegex != "" {
 			// this is a text replacement modification after yq operations
@@ -129,37 +156,58 @@ func (m *modifier) applyModifications(manifest *map[string]any, mods *[]common.M
 		}
 
 		if mod.Kind != "" {
-			kind, ok := (*manifest)[common.Kind].(string)
 			kindMatches, err := common.Matches(mod.Kind, kind)
 			if err != nil {
 				return nil, nil, err
 			}
-			if !ok || !kindMatches {
+			if !kindMatches {
 				continue
 			}
 		}
 
 		if mod.Reject != "" {
-			kind, ok := (*manifest)[common.Kind].(string)
 			kindMatches, err := common.Matches(mod.Reject, kind)
 			if err != nil {
 				return nil, nil, err
 			}
-			if ok && kindMatches {
+			if kindMatches {
 				common.Log.Debugf("Omitting manifest of kind '%s' due to reject rule", kind)
 				continue
 			}
 		}
 
+		if mod.Selector != nil {
+			matches, err := mod.Selector.Matches(manifest)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !matches {
+				continue
+			}
+		}
+
+		if mod.Path != "" {
+			compiled, err := m.compileParametrize(chartName, &mod, candidNode)
+			if err != nil {
+				return nil, nil, err
+			}
+			if compiled == nil {
+				continue
+			}
+			mod = *compiled
+		}
+
 		valuesMap := new(map[string]any)
-		if mod.ValuesSelector != nil {
-			matches := common.ValuesRegexCompiled.FindAllStringSubmatch(mod.Expression, -1)
+		selected := make([]*list.List, len(mod.ValuesSelector))
+		if len(mod.ValuesSelector) > 0 {
+			matches := common.ValuesRegexCompiled.FindAllStringSubmatch(mod.Expression+mod.JsonPatch+mod.StrategicMergePatch, -1)
 			for i, sel := range mod.ValuesSelector {
-				vals, err := m.evaluator.EvaluateNodes(sel, candidNode)
+				vals, err := m.evaluator.EvaluateNodes(sel, candidNode.Copy()) // traversal auto-creates absent keys
 				if err != nil {
 					common.Log.Errorf("Failed to apply values selector '%s' on manifest: %v", mod.ValuesSelector, err)
 					return nil, nil, err
 				}
+				selected[i] = vals
 
 				if len(matches) >= 1 {
 					vm, err := m.wrapResult(vals, matches[i][1])
@@ -175,25 +223,118 @@ func (m *modifier) applyModifications(manifest *map[string]any, mods *[]common.M
 			}
 		}
 
-		result, err := m.evaluator.EvaluateNodes(mod.Expression, candidNode)
-		if err != nil {
-			common.Log.Errorf("Failed to apply expression '%s' on manifest: %v", mod.Expression, err)
-			return nil, nil, err
+		var err error
+		if isPatch(&mod) {
+			candidNode, err = m.patch(&mod, candidNode)
+		} else {
+			candidNode, err = m.evaluate(&mod, candidNode)
 		}
-		resultManifest, err := m.resultToMap(result)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		if !reflect.DeepEqual(modifiedManifest, *resultManifest) {
-			// only now deep merge values
-			extractedValues = *common.DeepMerge(&extractedValues, valuesMap)
+		if len(mod.ValuesSelector) > 0 {
+			changed, err := m.selectionChanged(mod.ValuesSelector, selected, candidNode)
+			if err != nil {
+				return nil, nil, err
+			}
+			if changed {
+				// only now deep merge values
+				extractedValues = *common.DeepMerge(&extractedValues, valuesMap)
+			}
 		}
-		modifiedManifest = *resultManifest
 	}
-	common.Log.Tracef("Modified manifest:\n%+v", modifiedManifest)
 	common.Log.Tracef("Extracted values:\n%+v", extractedValues)
-	return &modifiedManifest, &extractedValues, nil
+	return candidNode, &extractedValues, nil
+}
+
+// selectionChanged reports whether the modification replaced any of the nodes selected by the values selectors
+func (m *modifier) selectionChanged(selectors []string, before []*list.List, candidNode *yqlib.CandidateNode) (bool, error) {
+	for i, sel := range selectors {
+		after, err := m.evaluator.EvaluateNodes(sel, candidNode.Copy())
+		if err != nil {
+			return false, err
+		}
+		if after.Len() != before[i].Len() {
+			return true, nil
+		}
+		for a, b := after.Front(), before[i].Front(); a != nil; a, b = a.Next(), b.Next() {
+			if !sameNode(a.Value.(*yqlib.CandidateNode), b.Value.(*yqlib.CandidateNode)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sameNode compares the content of the nodes, ignoring their style and comments
+func sameNode(a, b *yqlib.CandidateNode) bool {
+	if a.Kind != b.Kind || a.Tag != b.Tag || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !sameNode(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate applies the yq expression of the modification, yq updates the node in place, expressions producing a new document replace it
+func (m *modifier) evaluate(mod *common.Modification, candidNode *yqlib.CandidateNode) (*yqlib.CandidateNode, error) {
+	result, err := m.evaluator.EvaluateNodes(mod.Expression, candidNode)
+	if err != nil {
+		common.Log.Errorf("Failed to apply expression '%s' on manifest: %v", mod.Expression, err)
+		return nil, err
+	}
+	if result.Len() > 1 {
+		return nil, fmt.Errorf("expression '%s' produced %d documents from manifest of kind %s", mod.Expression, result.Len(), common.ManifestKind(candidNode))
+	}
+	if result.Len() == 1 {
+		if resultNode := result.Front().Value.(*yqlib.CandidateNode); resultNode.Kind == yqlib.MappingNode && resultNode.Parent == nil {
+			return resultNode, nil
+		}
+	}
+	return candidNode, nil
+}
+
+// compileParametrize turns the Path/ValuesKey modification into the Expression and ValuesSelector form,
+// the template renders scalars inline (strings quoted) and maps or lists as indented YAML block.
+// Returns nil when the manifest has no value under the Path, the modification is skipped for that manifest
+func (m *modifier) compileParametrize(chartName string, mod *common.Modification, candidNode *yqlib.CandidateNode) (*common.Modification, error) {
+	if !valuesKeyRegex.MatchString(mod.ValuesKey) {
+		return nil, fmt.Errorf("modification of path '%s' has invalid valuesKey '%s'", mod.Path, mod.ValuesKey)
+	}
+	result, err := m.evaluator.EvaluateNodes(mod.Path, candidNode.Copy()) // traversal auto-creates absent keys
+	if err != nil {
+		common.Log.Errorf("Failed to evaluate path '%s' on manifest: %v", mod.Path, err)
+		return nil, err
+	}
+	if result.Len() != 1 {
+		return nil, fmt.Errorf("path '%s' must select exactly one field, selected %d", mod.Path, result.Len())
+	}
+	node := result.Front().Value.(*yqlib.CandidateNode)
+	if node.Tag == "!!null" {
+		common.Log.Warnf("Chart %s: manifest %s of kind %s has no value under path '%s', skipping its parametrization", chartName, common.FieldValue(candidNode, "metadata", "name"), common.ManifestKind(candidNode), mod.Path)
+		return nil, nil
+	}
+
+	var template string
+	switch {
+	case node.Kind == yqlib.MappingNode || node.Kind == yqlib.SequenceNode:
+		template = fmt.Sprintf("{{ .Values.%s | toYaml | nindent %s }}", mod.ValuesKey, AutoIndent)
+	case node.Tag == "!!str":
+		template = fmt.Sprintf("{{ .Values.%s | quote }}", mod.ValuesKey)
+	default:
+		template = fmt.Sprintf("{{ .Values.%s }}", mod.ValuesKey)
+	}
+
+	compiled := *mod
+	compiled.Path = ""
+	compiled.Expression = fmt.Sprintf(`%s |= "%s"`, mod.Path, template)
+	compiled.ValuesSelector = []string{mod.Path}
+	common.Log.Debugf("Compiled parametrization of '%s' to: %s", mod.Path, compiled.Expression)
+	return &compiled, nil
 }
 
 func (m *modifier) wrapResult(result *list.List, underPath string) (*map[string]any, error) {
@@ -231,10 +372,6 @@ func (m *modifier) resultToAny(result *list.List) (any, error) {
 	return decodeResult[any](m, result)
 }
 
-func (m *modifier) resultToMap(result *list.List) (*map[string]any, error) {
-	return decodeResult[*map[string]any](m, result)
-}
-
 // generic decoder
 func decodeResult[T any](m *modifier, result *list.List) (T, error) {
 	var zero T
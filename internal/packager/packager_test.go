@@ -1,21 +1,58 @@
 package packager
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/kiemlicz/charter/internal/common"
+	"github.com/kiemlicz/charter/internal/updater/olm"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
 	"gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
 )
 
 const (
-	TestChartDir   = "testdata/charts"
-	TestPackageDir = "testdata/packaged"
+	TestChartDir           = "testdata/charts"
+	TestPackageDir         = "testdata/packaged"
+	testChartName          = "test"
+	testOperatorDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: operator
+  template:
+    metadata:
+      annotations:
+        scrape: "true"
+      labels:
+        app: operator
+    spec:
+      containers:
+      - env:
+        - name: WATCH_NAMESPACE
+          value: ""
+        image: quay.io/acme/operator:v1.0.0
+        name: operator
+        resources:
+          requests:
+            cpu: 10m
+      nodeSelector:
+        kubernetes.io/os: linux
+`
 )
 
 var testHelmSettings = common.HelmSettings{
@@ -121,7 +158,7 @@ func TestValuesExtraction(t *testing.T) {
 			//given
 
 			//when
-			modifiedManifests, err := ChartModifier.ParametrizeManifests(testManifests, &tc.modifications)
+			modifiedManifests, err := ChartModifier.ParametrizeManifests(testChartName, testManifests, &tc.modifications)
 
 			//then
 			if err != nil {
@@ -129,7 +166,8 @@ func TestValuesExtraction(t *testing.T) {
 				return
 			}
 
-			for _, m := range (*modifiedManifests).Manifests {
+			for _, node := range (*modifiedManifests).Manifests {
+				m := manifestMap(t, node)
 				if !mapContains(&m, &tc.expectedChanges, false) {
 					t.Errorf("TestValuesExtraction() modified manifest:\n%v, but wanted:\n%v", mustYaml(m), mustYaml(tc.expectedChanges))
 					return
@@ -157,7 +195,7 @@ func TestParametrizeListElement(t *testing.T) {
 	}
 
 	//when
-	modifiedManifests, err := ChartModifier.ParametrizeManifests(testManifests, &mods)
+	modifiedManifests, err := ChartModifier.ParametrizeManifests(testChartName, testManifests, &mods)
 
 	//then
 	if err != nil {
@@ -179,8 +217,8 @@ func TestParametrizeListElement(t *testing.T) {
 		},
 	}
 
-	for _, m := range (*modifiedManifests).Manifests {
-		if m["kind"] == "RoleBinding" && m["metadata"].(map[string]any)["name"] == "kubevirt-operator-rolebinding" {
+	for _, node := range (*modifiedManifests).Manifests {
+		if m := manifestMap(t, node); m["kind"] == "RoleBinding" && m["metadata"].(map[string]any)["name"] == "kubevirt-operator-rolebinding" {
 			if !mapContains(&m, &expectedChanges, true) {
 				t.Errorf("ParametrizeManifests() modified manifest: \n%v,but wanted:\n%v", mustYaml(m), mustYaml(expectedChanges))
 			}
@@ -190,6 +228,109 @@ func TestParametrizeListElement(t *testing.T) {
 	t.Errorf("ParametrizeManifests() did not find a matching RoleBinding manifest or did not match expected changes")
 }
 
+func TestFilterManifests(t *testing.T) {
+	tests := []struct {
+		name          string
+		drop          []string
+		dropSelectors []common.Selector
+		wantDropped   []string
+	}{
+		{"kind", []string{"serviceaccount"}, nil, []string{"ServiceAccount/cdi-operator", "ServiceAccount/kubevirt-operator"}},
+		{"kind and name", nil, []common.Selector{{Kind: "^ServiceAccount$", Name: "^kubevirt-"}}, []string{"ServiceAccount/kubevirt-operator"}},
+		{"group and label", nil, []common.Selector{{Group: "^apps$", Labels: map[string]string{"cdi.kubevirt.io": "operator"}}}, []string{"Deployment/cdi-operator"}},
+		{"core group and namespace", nil, []common.Selector{{Group: "^$", Kind: "Account", Namespace: "^cdi$"}}, []string{"ServiceAccount/cdi-operator"}},
+		{"missing annotation", nil, []common.Selector{{Kind: "Deployment", Annotations: map[string]string{"missing": ".*"}}}, nil},
+		{"crd", nil, []common.Selector{{Kind: "^CustomResourceDefinition$", Name: "^kubevirts\\."}}, []string{"CustomResourceDefinition/kubevirts.kubevirt.io"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			manifests, _ := getTestManifests(t)
+
+			//when
+			filtered, err := ChartModifier.FilterManifests(manifests, tt.drop, tt.dropSelectors)
+
+			//then
+			if err != nil {
+				t.Fatalf("FilterManifests() error = %v", err)
+			}
+			kept := make(map[string]bool, len(filtered.Manifests)+len(filtered.Crds))
+			for _, m := range slices.Concat(filtered.Manifests, filtered.Crds) {
+				kept[manifestId(m)] = true
+			}
+			dropped := make([]string, 0)
+			for _, m := range slices.Concat(manifests.Manifests, manifests.Crds) {
+				if !kept[manifestId(m)] {
+					dropped = append(dropped, manifestId(m))
+				}
+			}
+			slices.Sort(dropped)
+			if !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("FilterManifests() dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestModificationSelector(t *testing.T) {
+	//given
+	testManifests, _ := getTestManifests(t)
+	mods := []common.Modification{
+		{Path: ".spec.replicas", ValuesKey: "operator.replicas", Selector: &common.Selector{Kind: "^Deployment$", Name: "^cdi-"}},
+	}
+
+	//when
+	modifiedManifests, err := ChartModifier.ParametrizeManifests(testChartName, testManifests, &mods)
+
+	//then
+	if err != nil {
+		t.Fatalf("ParametrizeManifests() error = %v", err)
+	}
+	for _, m := range modifiedManifests.Manifests {
+		if common.ManifestKind(m) != "Deployment" {
+			continue
+		}
+		replicas := common.FieldValue(m, "spec", "replicas")
+		if templated := replicas == "{{ .Values.operator.replicas }}"; templated != (manifestId(m) == "Deployment/cdi-operator") {
+			t.Errorf("ParametrizeManifests() %s replicas = %v, want only cdi-operator templated", manifestId(m), replicas)
+		}
+	}
+	if replicas := modifiedManifests.Values["operator"].(map[string]any)["replicas"]; replicas != 1 {
+		t.Errorf("ParametrizeManifests() values replicas = %v, want 1 of cdi-operator", replicas)
+	}
+}
+
+func TestValuesExtractionUnchangedSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		wantValues bool
+	}{
+		{"selected value replaced", `.spec.replicas |= "{{ .Values.operator.replicas }}"`, true},
+		{"other fields changed only", `.metadata.annotations.touched = "true" | (.spec.replicas | select(. > 5)) |= "{{ .Values.operator.replicas }}"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			testManifests, _ := getTestManifests(t)
+			mods := []common.Modification{
+				{Expression: tt.expression, ValuesSelector: []string{".spec.replicas"}, Kind: "^Deployment$"},
+			}
+
+			//when
+			modifiedManifests, err := ChartModifier.ParametrizeManifests(testChartName, testManifests, &mods)
+
+			//then
+			if err != nil {
+				t.Fatalf("ParametrizeManifests() error = %v", err)
+			}
+			if _, extracted := modifiedManifests.Values["operator"]; extracted != tt.wantValues {
+				t.Errorf("ParametrizeManifests() values = %v, want operator values extracted: %t", modifiedManifests.Values, tt.wantValues)
+			}
+		})
+	}
+}
+
 func TestMultiValueSelector(t *testing.T) {
 	//given
 	testManifests, _ := getTestManifests(t)
@@ -205,7 +346,7 @@ func TestMultiValueSelector(t *testing.T) {
 	}
 
 	//when
-	modifiedManifests, err := ChartModifier.ParametrizeManifests(testManifests, &mods)
+	modifiedManifests, err := ChartModifier.ParametrizeManifests(testChartName, testManifests, &mods)
 
 	//then
 	if err != nil {
@@ -224,6 +365,230 @@ func TestMultiValueSelector(t *testing.T) {
 	}
 }
 
+func TestParametrizePath(t *testing.T) {
+	//given
+	assets := map[string][]byte{"operator.yaml": []byte(testOperatorDeployment)}
+	manifests, err := common.NewManifests(&assets, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+	if err != nil {
+		t.Fatalf("NewManifests() error = %v", err)
+	}
+	helmOps := common.HelmOps{
+		ChartName: "operator",
+		Modifications: []common.Modification{
+			{Path: ".spec.replicas", ValuesKey: "operator.replicas", Kind: "Deployment"},
+			{Path: ".spec.template.metadata.annotations.scrape", ValuesKey: "operator.scrape"},
+			{Path: ".spec.template.spec.containers[0].image", ValuesKey: "operator.image"},
+			{Path: ".spec.template.spec.containers[0].env", ValuesKey: "operator.env"},
+			{Path: ".spec.template.spec.containers[0].resources", ValuesKey: "operator.resources"},
+			{Path: ".spec.template.spec.nodeSelector", ValuesKey: "operator.nodeSelector"},
+			{Path: ".spec.template.spec.tolerations", ValuesKey: "operator.tolerations"}, // absent, left out
+		},
+	}
+
+	//when
+	helmCharts, err := Prepare(manifests, &helmOps, &testHelmSettings)
+
+	//then
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	operatorValues, _ := helmCharts.Chart.Values["operator"].(map[string]any)
+	if operatorValues["replicas"] != 2 || operatorValues["scrape"] != "true" || operatorValues["image"] != "quay.io/acme/operator:v1.0.0" {
+		t.Errorf("Prepare() values = %v, want the original scalars", operatorValues)
+	}
+	if _, exists := operatorValues["tolerations"]; exists {
+		t.Errorf("Prepare() values = %v, want no values of absent fields", operatorValues)
+	}
+	rendered, err := engine.Render(helmCharts.Chart, mustRenderValues(t, helmCharts.Chart))
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	var got, want map[string]any
+	if err := yaml.Unmarshal([]byte(rendered["operator/templates/deployment.yaml"]), &got); err != nil {
+		t.Fatalf("rendered template is not valid YAML: %v\n%s", err, rendered["operator/templates/deployment.yaml"])
+	}
+	_ = yaml.Unmarshal([]byte(testOperatorDeployment), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rendered template:\n%v, want the original manifest:\n%v", mustYaml(got), mustYaml(want))
+	}
+}
+
+func TestPatchModifications(t *testing.T) {
+	deployment := `# operator of the acme stack
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+spec:
+  template:
+    spec:
+      containers:
+      - name: operator # main container
+        image: quay.io/acme/operator:v1.0.0
+        env:
+        - name: VERBOSITY
+          value: "1"
+      - name: sidecar
+        image: quay.io/acme/sidecar:v1.0.0
+`
+	tests := []struct {
+		name         string
+		manifest     string
+		modification common.Modification
+		want         string
+		wantValues   map[string]any
+	}{
+		{
+			name:     "json patch",
+			manifest: deployment,
+			modification: common.Modification{
+				JsonPatch: "- op: replace\n  path: /spec/template/spec/containers/1/image\n  value: quay.io/acme/sidecar:v2.0.0\n",
+				Kind:      "Deployment",
+			},
+			want: `# operator of the acme stack
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+    name: operator
+spec:
+    template:
+        spec:
+            containers:
+                - name: operator # main container
+                  image: quay.io/acme/operator:v1.0.0
+                  env:
+                    - name: VERBOSITY
+                      value: "1"
+                - name: sidecar
+                  image: quay.io/acme/sidecar:v2.0.0
+`,
+		},
+		{
+			name:     "strategic merge patch merges lists by key",
+			manifest: deployment,
+			modification: common.Modification{
+				StrategicMergePatch: `spec:
+  template:
+    spec:
+      containers:
+      - name: operator
+        env:
+        - name: VERBOSITY
+          value: "2"
+        - name: DEBUG
+          value: "true"
+`,
+			},
+			want: `# operator of the acme stack
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+    name: operator
+spec:
+    template:
+        spec:
+            containers:
+                - name: operator # main container
+                  image: quay.io/acme/operator:v1.0.0
+                  env:
+                    - name: VERBOSITY
+                      value: "2"
+                    - name: DEBUG
+                      value: "true"
+                - name: sidecar
+                  image: quay.io/acme/sidecar:v1.0.0
+`,
+		},
+		{
+			name:     "strategic merge patch with values",
+			manifest: deployment,
+			modification: common.Modification{
+				StrategicMergePatch: "spec:\n  template:\n    spec:\n      containers:\n      - name: sidecar\n        image: '{{ .Values.sidecar.image }}'\n",
+				ValuesSelector:      []string{".spec.template.spec.containers[1].image"},
+			},
+			want: `# operator of the acme stack
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+    name: operator
+spec:
+    template:
+        spec:
+            containers:
+                - name: operator # main container
+                  image: quay.io/acme/operator:v1.0.0
+                  env:
+                    - name: VERBOSITY
+                      value: "1"
+                - name: sidecar
+                  image: '{{ .Values.sidecar.image }}'
+`,
+			wantValues: map[string]any{"sidecar": map[string]any{"image": "quay.io/acme/sidecar:v1.0.0"}},
+		},
+		{
+			name:     "rejected kind",
+			manifest: deployment,
+			modification: common.Modification{
+				StrategicMergePatch: "metadata:\n  name: renamed\n",
+				Reject:              "Deployment",
+			},
+			want: `# operator of the acme stack
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+    name: operator
+spec:
+    template:
+        spec:
+            containers:
+                - name: operator # main container
+                  image: quay.io/acme/operator:v1.0.0
+                  env:
+                    - name: VERBOSITY
+                      value: "1"
+                - name: sidecar
+                  image: quay.io/acme/sidecar:v1.0.0
+`,
+		},
+		{
+			name:     "custom resource is merge patched",
+			manifest: "apiVersion: acme.io/v1\nkind: Operator\nmetadata:\n  name: acme\nspec:\n  replicas: 1\n  featureGates:\n  - Snapshots\n",
+			modification: common.Modification{
+				StrategicMergePatch: "spec:\n  featureGates:\n  - Clones\n  replicas: null\n",
+			},
+			want: "apiVersion: acme.io/v1\nkind: Operator\nmetadata:\n    name: acme\nspec:\n    featureGates:\n        - Clones\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			assets := map[string][]byte{"manifest.yaml": []byte(tt.manifest)}
+			manifests, err := common.NewManifests(&assets, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+			if err != nil {
+				t.Fatalf("NewManifests() error = %v", err)
+			}
+
+			//when
+			modified, err := ChartModifier.ParametrizeManifests(testChartName, manifests, &[]common.Modification{tt.modification})
+
+			//then
+			if err != nil {
+				t.Fatalf("ParametrizeManifests() error = %v", err)
+			}
+			got, err := ChartModifier.encode(modified.Manifests[0])
+			if err != nil {
+				t.Fatalf("encode() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ParametrizeManifests() manifest:\n%s, want:\n%s", got, tt.want)
+			}
+			if tt.wantValues != nil && !reflect.DeepEqual(modified.Values, tt.wantValues) {
+				t.Errorf("ParametrizeManifests() values = %v, want %v", modified.Values, tt.wantValues)
+			}
+		})
+	}
+}
+
 func TestInsertHelpers(t *testing.T) {
 	//given
 	kind := "ClusterRole"
@@ -265,6 +630,185 @@ func TestInsertHelpers(t *testing.T) {
 	}
 }
 
+func TestPrepareOptional(t *testing.T) {
+	//given
+	assets := map[string][]byte{"operator.yaml": []byte(testOperatorDeployment + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: dashboards
+data:
+  operator.json: "{}"
+`)}
+	manifests, err := common.NewManifests(&assets, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+	if err != nil {
+		t.Fatalf("NewManifests() error = %v", err)
+	}
+	helmOps := common.HelmOps{
+		ChartName: "optional",
+		Optional: []common.Optional{
+			{Selector: common.Selector{Kind: "^ConfigMap$", Name: "^dashboards$"}, ValuesKey: "monitoring.dashboards", Disabled: true},
+			{Selector: common.Selector{Kind: "^Deployment$"}, ValuesKey: "operator"},
+		},
+	}
+
+	//when
+	helmCharts, err := Prepare(manifests, &helmOps, &testHelmSettings)
+
+	//then
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	wantValues := map[string]any{
+		"monitoring": map[string]any{"dashboards": map[string]any{"enabled": false}},
+		"operator":   map[string]any{"enabled": true},
+	}
+	if !mapContains(&helmCharts.Chart.Values, &wantValues, true) {
+		t.Errorf("Prepare() values = %v, want toggles' defaults %v", helmCharts.Chart.Values, wantValues)
+	}
+	for _, enabled := range []bool{false, true} {
+		c := *helmCharts.Chart
+		c.Values = *common.DeepMerge(&c.Values, &map[string]any{"monitoring": map[string]any{"dashboards": map[string]any{"enabled": enabled}}})
+		rendered, err := engine.Render(&c, mustRenderValues(t, &c))
+		if err != nil {
+			t.Fatalf("Render() error = %v", err)
+		}
+		configMaps := rendered["optional/templates/configmap.yaml"]
+		if strings.Contains(configMaps, "name: dashboards") != enabled || !strings.Contains(configMaps, "name: settings") {
+			t.Errorf("rendered ConfigMaps with dashboards enabled: %t:\n%s", enabled, configMaps)
+		}
+		if !strings.Contains(rendered["optional/templates/deployment.yaml"], "name: operator") {
+			t.Errorf("rendered Deployment enabled by default missing:\n%s", rendered["optional/templates/deployment.yaml"])
+		}
+	}
+}
+
+func TestResolveAutoIndent(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     string
+	}{
+		{
+			"mapping",
+			"spec:\n    template:\n        spec:\n            nodeSelector: {{ .Values.nodeSelector | toYaml | nindent AUTO }}\n",
+			"spec:\n    template:\n        spec:\n            nodeSelector: {{ .Values.nodeSelector | toYaml | nindent 16 }}\n",
+		},
+		{
+			"first key of list item",
+			"containers:\n    - env: {{ .Values.env | toYaml | nindent AUTO }}\n      name: operator\n",
+			"containers:\n    - env: {{ .Values.env | toYaml | nindent 8 }}\n      name: operator\n",
+		},
+		{
+			"key of list item",
+			"containers:\n    - args:\n        - --port\n      resources: {{- .Values.resources | toYaml | nindent AUTO }}\n",
+			"containers:\n    - args:\n        - --port\n      resources: {{- .Values.resources | toYaml | nindent 8 }}\n",
+		},
+		{
+			"fixed indentation",
+			"metadata:\n    labels: {{- include \"labels\" . | nindent 8 }}\n",
+			"metadata:\n    labels: {{- include \"labels\" . | nindent 8 }}\n",
+		},
+		{
+			"following template lines",
+			"spec:\n    template:\n        metadata:\n            labels: {{- include \"labels\" . | nindent AUTO }}\n{{ .Values.podLabels | toYaml | nindent AUTO }}\n",
+			"spec:\n    template:\n        metadata:\n            labels: {{- include \"labels\" . | nindent 16 }}\n{{ .Values.podLabels | toYaml | nindent 16 }}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(resolveAutoIndent([]byte(tt.manifest))); got != tt.want {
+				t.Errorf("resolveAutoIndent() =\n%s, want:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("textRegex expression", func(t *testing.T) {
+		//given
+		upstream := map[string][]byte{"deployment.yaml": []byte("kind: Deployment\nmetadata:\n  name: operator\nspec:\n  template:\n    metadata:\n      labels:\n        app: operator\n")}
+		manifests, _ := common.NewManifests(&upstream, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+		mods := []common.Modification{
+			{Expression: `.spec.template.metadata.labels |= "{{ .Values.podLabels }}"`},
+			{Expression: "{{- include \"labels\" . | nindent AUTO }}\n{{ .Values.podLabels | toYaml | nindent AUTO }}", TextRegex: "{{ .Values.podLabels }}", Kind: "Deployment"},
+		}
+		modified, err := ChartModifier.ParametrizeManifests(testChartName, manifests, &mods)
+		if err != nil {
+			t.Fatalf("ParametrizeManifests() error = %v", err)
+		}
+
+		//when
+		templates, err := createTemplates(&modified.Manifests, nil, &mods)
+
+		//then
+		if err != nil {
+			t.Fatalf("createTemplates() error = %v", err)
+		}
+		want := "            labels: {{- include \"labels\" . | nindent 16 }}\n{{ .Values.podLabels | toYaml | nindent 16 }}\n"
+		if got := string(templates[0].Data); !strings.Contains(got, want) {
+			t.Errorf("createTemplates() =\n%s, want:\n%s", got, want)
+		}
+	})
+}
+
+func TestMaterializeTemplates(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       string
+	}{
+		{
+			"embedded in string",
+			`.metadata.name |= "{{ .Release.Name }}-" + .`,
+			"metadata:\n    name: {{ .Release.Name }}-operator\n",
+		},
+		{
+			"quotes",
+			`.metadata.name |= "{{ include \"operator.fullname\" . }}"`,
+			"metadata:\n    name: {{ include \"operator.fullname\" . }}\n",
+		},
+		{
+			"multi-line",
+			`.metadata.name |= "{{- if .Values.prefixed }}\n{{ .Release.Name }}-\n{{- end }}" + .`,
+			"metadata:\n    name: {{- if .Values.prefixed }}\n{{ .Release.Name }}-\n{{- end }}operator\n",
+		},
+		{
+			"templated block before a later modification",
+			`.metadata.labels |= "{{ .Values.labels | toYaml | nindent AUTO }}" | .metadata.name |= "{{ .Release.Name }}"`,
+			"metadata:\n    name: {{ .Release.Name }}\n    labels: {{ .Values.labels | toYaml | nindent 8 }}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			upstream := map[string][]byte{"cm.yaml": []byte("kind: ConfigMap\nmetadata:\n  name: \"operator\"\n")}
+			manifests, _ := common.NewManifests(&upstream, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+			mods := []common.Modification{*common.NewYqModification(tt.expression)}
+			modified, err := ChartModifier.ParametrizeManifests(testChartName, manifests, &mods)
+			if err != nil {
+				t.Fatalf("ParametrizeManifests() error = %v", err)
+			}
+
+			//when
+			templates, err := createTemplates(&modified.Manifests, nil, &mods)
+
+			//then
+			if err != nil {
+				t.Fatalf("createTemplates() error = %v", err)
+			}
+			if got := string(templates[0].Data); got != "kind: ConfigMap\n"+tt.want {
+				t.Errorf("createTemplates() =\n%s, want:\n%s", got, "kind: ConfigMap\n"+tt.want)
+			}
+		})
+	}
+}
+
 func TestPrepare(t *testing.T) { // this is actually an integration test with both parametrize and insertion of templates
 	//given
 	manifests, _ := getTestManifests(t)
@@ -305,6 +849,335 @@ func TestPrepare(t *testing.T) { // this is actually an integration test with bo
 	}
 }
 
+func TestPrepareKeepsUpstreamLayout(t *testing.T) {
+	//given
+	upstream := `# operator of the acme stack
+kind: ConfigMap
+apiVersion: v1
+metadata:
+  name: operator # stable name
+data:
+  zone: eu
+  account: acme
+`
+	assets := map[string][]byte{"operator.yaml": []byte(upstream)}
+	manifests, err := common.NewManifests(&assets, mustSemver("1.0.0"), "v1.0.0", new(map[string]any), new(map[string]any))
+	if err != nil {
+		t.Fatalf("NewManifests() error = %v", err)
+	}
+	helmOps := common.HelmOps{
+		ChartName:     "operator",
+		Modifications: []common.Modification{{Path: ".data.zone", ValuesKey: "zone"}},
+	}
+
+	//when
+	helmCharts, err := Prepare(manifests, &helmOps, &testHelmSettings)
+
+	//then
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	template := getTemplate("templates/configmap.yaml", helmCharts.Chart.Templates)
+	if template == nil {
+		t.Fatalf("Prepare() templates = %v, want templates/configmap.yaml", helmCharts.Chart.Templates)
+	}
+	want := `# operator of the acme stack
+kind: ConfigMap
+apiVersion: v1
+metadata:
+    name: operator # stable name
+data:
+    zone: {{ .Values.zone | quote }}
+    account: acme
+`
+	if string(template.Data) != want {
+		t.Errorf("Prepare() template:\n%s, want upstream key order and comments:\n%s", template.Data, want)
+	}
+}
+
+func TestFetchAndUpdateReleaseLine(t *testing.T) {
+	//given
+	manifests, _ := getTestManifests(t)
+	source := &staticSource{
+		manifests: manifests,
+		helmOps: common.HelmOps{
+			ChartName:    "cdi",
+			Line:         "0.0",
+			AddValues:    map[string]any{},
+			AddCrdValues: map[string]any{},
+		},
+	}
+
+	//when
+	helmCharts, err := FetchAndUpdate(context.Background(), source, &testHelmSettings)
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchAndUpdate() error = %v", err)
+	}
+	lineDir := filepath.Join(TestChartDir, common.LinesDir, "0.0")
+	if helmCharts.Path != lineDir || helmCharts.Line != "0.0" {
+		t.Errorf("charts of release line stored in %s (line %q), expected %s", helmCharts.Path, helmCharts.Line, lineDir)
+	}
+	version, appVersion, err := PeekVersions(lineDir, "cdi")
+	if err != nil || version != "0.0.1" || appVersion != "0.0.1" {
+		t.Errorf("PeekVersions() = %s, %s, %v, expected the release line chart at 0.0.1", version, appVersion, err)
+	}
+	if source.existingVersion != "" {
+		t.Errorf("release line started from existing version %s, expected none", source.existingVersion)
+	}
+}
+
+func TestPrepareOlmBundle(t *testing.T) {
+	//given
+	source := olm.NewOlmSource(
+		&common.OlmSourceConfig{Path: filepath.Join("testdata", "bundle")},
+		&common.HelmOps{
+			ChartName:    "memcached-operator",
+			AddValues:    map[string]any{},
+			AddCrdValues: map[string]any{},
+		},
+	)
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	helmCharts, err := Prepare(manifests, source.HelmOps(), &testHelmSettings)
+
+	//then
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if helmCharts.AppVersion() != "0.3.1" {
+		t.Errorf("chart appVersion = %s, want the CSV's version 0.3.1", helmCharts.AppVersion())
+	}
+	for _, name := range []string{"deployment", "serviceaccount", "clusterrole", "clusterrolebinding", "role", "rolebinding", "service", "customresourcedefinition"} {
+		if getTemplate(fmt.Sprintf("templates/%s.yaml", name), helmCharts.Chart.Templates) == nil {
+			t.Errorf("chart has no %s template converted from the OLM bundle", name)
+		}
+	}
+	binding := string(getTemplate("templates/clusterrolebinding.yaml", helmCharts.Chart.Templates).Data)
+	expectedSubject := `    - kind: ServiceAccount
+      name: memcached-operator-controller-manager
+      namespace: {{ .Release.Namespace }}
+`
+	if !strings.Contains(binding, expectedSubject) {
+		t.Errorf("ClusterRoleBinding:\n%s, does not bind the CSV's service account:\n%s", binding, expectedSubject)
+	}
+	expectedName := "name: memcached-operator.v0.3.1-memcached-operator-controller-manager"
+	if strings.Count(binding, expectedName) != 2 {
+		t.Errorf("ClusterRoleBinding:\n%s, expected it and its ClusterRole named %s", binding, expectedName)
+	}
+	role := string(getTemplate("templates/rolebinding.yaml", helmCharts.Chart.Templates).Data)
+	if !strings.Contains(role, "namespace: {{ .Release.Namespace }}") {
+		t.Errorf("RoleBinding:\n%s, does not bind the service account of the release namespace", role)
+	}
+	deployment := string(getTemplate("templates/deployment.yaml", helmCharts.Chart.Templates).Data)
+	if !strings.Contains(deployment, "image: quay.io/example/memcached-operator:v0.3.1") {
+		t.Errorf("Deployment:\n%s, does not contain the CSV's deployment spec", deployment)
+	}
+	expectedContainer := `                - name: manager
+                  image: quay.io/example/memcached-operator:v0.3.1
+                  args:
+                    - --leader-elect
+`
+	if !strings.Contains(deployment, "replicas: 1 # scaled by the chart values") || !strings.Contains(deployment, expectedContainer) {
+		t.Errorf("Deployment:\n%s, does not keep the key order and comments of the CSV's deployment spec", deployment)
+	}
+}
+
+func TestUpdateUmbrellasPendingDependency(t *testing.T) {
+	//given
+	settings := testHelmSettings
+	settings.SrcDir = filepath.Join(t.TempDir(), "charts")
+	helmOps := common.HelmOps{ChartName: "cdi", AddValues: map[string]any{}, AddCrdValues: map[string]any{}}
+	umbrellas := []common.Umbrella{{
+		Name:         "virtualization",
+		Dependencies: []common.UmbrellaDependency{{Chart: "kubevirt"}, {Chart: "cdi"}},
+	}}
+	merged, err := PeekMergedCharts(umbrellas, []string{settings.SrcDir})
+	if err != nil {
+		t.Fatalf("PeekMergedCharts() error = %v", err)
+	}
+	manifests, _ := getTestManifests(t)
+	charts, err := Prepare(manifests, &helmOps, &settings)
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+
+	//when
+	updated, err := UpdateUmbrellas(umbrellas, merged, charts, &settings)
+
+	//then
+	if err != nil {
+		t.Fatalf("UpdateUmbrellas() error = %v", err)
+	}
+	if len(updated) != 0 {
+		t.Errorf("UpdateUmbrellas() = %v, expected no umbrella chart before all its dependencies are merged", updated)
+	}
+	if _, err := os.Stat(filepath.Join(settings.SrcDir, "virtualization")); !os.IsNotExist(err) {
+		t.Errorf("umbrella chart saved before its dependencies are merged, stat error = %v", err)
+	}
+}
+
+func TestUpdateUmbrellasPinsMergedDependencies(t *testing.T) {
+	//given
+	settings := testHelmSettings
+	settings.SrcDir = filepath.Join(t.TempDir(), "charts")
+	cdiOps := common.HelmOps{ChartName: "cdi", AddValues: map[string]any{}, AddCrdValues: map[string]any{}}
+	kubevirtOps := common.HelmOps{ChartName: "kubevirt", AddValues: map[string]any{}, AddCrdValues: map[string]any{}}
+	umbrellas := []common.Umbrella{{
+		Name:         "virtualization",
+		Dependencies: []common.UmbrellaDependency{{Chart: "kubevirt"}, {Chart: "cdi"}},
+	}}
+	manifests, _ := getTestManifests(t)
+	if _, err := Prepare(manifests, &kubevirtOps, &settings); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	merged, err := PeekMergedCharts(umbrellas, []string{settings.SrcDir})
+	if err != nil {
+		t.Fatalf("PeekMergedCharts() error = %v", err)
+	}
+	// kubevirt updated in a pull request of its own, not merged yet
+	manifests.Version = *mustSemver("0.0.2")
+	manifests.AppVersion = "0.0.2"
+	if _, err := Prepare(manifests, &kubevirtOps, &settings); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	cdiManifests, _ := getTestManifests(t)
+	charts, err := Prepare(cdiManifests, &cdiOps, &settings)
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+
+	//when
+	updated, err := UpdateUmbrellas(umbrellas, merged, charts, &settings)
+
+	//then
+	if err != nil {
+		t.Fatalf("UpdateUmbrellas() error = %v", err)
+	}
+	if len(updated) != 1 {
+		t.Fatalf("UpdateUmbrellas() = %v, expected the umbrella chart created", updated)
+	}
+	versions := make(map[string]string)
+	for _, dependency := range updated[0].Metadata.Dependencies {
+		versions[dependency.Name] = dependency.Version
+	}
+	if versions["kubevirt"] != "0.0.1" || versions["cdi"] != "0.0.1" {
+		t.Errorf("UpdateUmbrellas() dependencies = %v, expected the merged kubevirt 0.0.1 and the updated cdi 0.0.1", versions)
+	}
+}
+
+func TestUpdateUmbrellas(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	settings := testHelmSettings
+	settings.SrcDir = filepath.Join(dir, "charts")
+	settings.TargetDir = filepath.Join(dir, "packaged")
+	settings.Remote = "oci://ghcr.io/kiemlicz/charter"
+	helmOps := common.HelmOps{ChartName: "cdi", SeparateCrds: true, AddValues: map[string]any{}, AddCrdValues: map[string]any{}}
+	umbrellas := []common.Umbrella{{
+		Name: "cdi-stack",
+		Dependencies: []common.UmbrellaDependency{
+			{Chart: "cdi-crds"},
+			{Chart: "cdi", Condition: "cdi.enabled"},
+		},
+	}}
+	manifests, _ := getTestManifests(t)
+	update := func() ([]*chart.Chart, error) {
+		merged, err := PeekMergedCharts(umbrellas, []string{settings.SrcDir})
+		if err != nil {
+			return nil, err
+		}
+		charts, err := Prepare(manifests, &helmOps, &settings)
+		if err != nil {
+			return nil, err
+		}
+		return UpdateUmbrellas(umbrellas, merged, charts, &settings)
+	}
+
+	//when
+	created, err := update()
+	unchanged, errUnchanged := update()
+	manifests.Version = *mustSemver("0.0.2")
+	manifests.AppVersion = "0.0.2"
+	bumped, errBumped := update()
+
+	//then
+	if err != nil || errUnchanged != nil || errBumped != nil {
+		t.Fatalf("UpdateUmbrellas() errors = %v, %v, %v", err, errUnchanged, errBumped)
+	}
+	if len(created) != 1 || created[0].Metadata.Version != InitialUmbrellaVersion {
+		t.Fatalf("UpdateUmbrellas() = %v, expected umbrella chart created at %s", created, InitialUmbrellaVersion)
+	}
+	if len(unchanged) != 0 {
+		t.Errorf("UpdateUmbrellas() = %v, expected no changes without new dependency versions", unchanged)
+	}
+	if len(bumped) != 1 || bumped[0].Metadata.Version != "0.1.1" || bumped[0].Metadata.AppVersion != "0.0.2" {
+		t.Fatalf("UpdateUmbrellas() = %v, expected umbrella chart bumped to 0.1.1", bumped)
+	}
+	for _, dependency := range bumped[0].Metadata.Dependencies {
+		if dependency.Version != "0.0.2" || dependency.Repository != settings.Remote {
+			t.Errorf("dependency %s: %s from %s, expected 0.0.2 from %s", dependency.Name, dependency.Version, dependency.Repository, settings.Remote)
+		}
+	}
+
+	for _, name := range []string{"cdi-crds", "cdi"} {
+		if _, err := Package(filepath.Join(settings.SrcDir, name), &settings); err != nil {
+			t.Fatalf("Package() error = %v", err)
+		}
+	}
+	packagedPath, err := PackageUmbrella(filepath.Join(settings.SrcDir, "cdi-stack"), &settings)
+	if err != nil {
+		t.Fatalf("PackageUmbrella() error = %v", err)
+	}
+	if filepath.Base(packagedPath) != "cdi-stack-0.1.1.tgz" {
+		t.Errorf("PackageUmbrella() = %s, expected cdi-stack-0.1.1.tgz", packagedPath)
+	}
+	packaged, err := loader.Load(packagedPath)
+	if err != nil || len(packaged.Dependencies()) != 2 {
+		t.Errorf("packaged umbrella chart %s doesn't vendor its dependencies: %v", packagedPath, err)
+	}
+}
+
+// staticSource serves the same manifests regardless of the existing versions
+type staticSource struct {
+	manifests       *common.Manifests
+	helmOps         common.HelmOps
+	existingVersion string
+}
+
+func (s *staticSource) Fetch(_ context.Context, currentVersion, _ string) (*common.Manifests, error) {
+	s.existingVersion = currentVersion
+	return s.manifests, nil
+}
+func (s *staticSource) ChartName() string        { return s.helmOps.ChartName }
+func (s *staticSource) HelmOps() *common.HelmOps { return &s.helmOps }
+
+func mustRenderValues(t *testing.T, c *chart.Chart) chartutil.Values {
+	t.Helper()
+	values, err := chartutil.ToRenderValues(c, c.Values, chartutil.ReleaseOptions{Name: c.Name(), Namespace: "default"}, nil)
+	if err != nil {
+		t.Fatalf("ToRenderValues() error = %v", err)
+	}
+	return values
+}
+
+func manifestId(manifest *yqlib.CandidateNode) string {
+	return fmt.Sprintf("%s/%s", common.ManifestKind(manifest), common.FieldValue(manifest, "metadata", "name"))
+}
+
+func manifestMap(t *testing.T, manifest *yqlib.CandidateNode) map[string]any {
+	m, err := common.ManifestMap(manifest)
+	if err != nil {
+		t.Fatalf("ManifestMap() error = %v", err)
+	}
+	return m
+}
+
 func getTemplate(name string, templates []*chart.File) *chart.File {
 	for _, tmpl := range templates {
 		if strings.EqualFold(tmpl.Name, name) {
@@ -0,0 +1,146 @@
+package packager
+
+import (
+	"fmt"
+	"slices"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// isPatch tells whether the modification is a JSON Patch or a strategic merge patch rather than a yq expression
+func isPatch(mod *common.Modification) bool {
+	return mod.JsonPatch != "" || mod.StrategicMergePatch != ""
+}
+
+// patch applies the JSON Patch or the strategic merge patch of the modification to the manifest,
+// the patched manifest keeps the key order and comments of the fields it shares with the original
+func (m *modifier) patch(mod *common.Modification, manifest *yqlib.CandidateNode) (*yqlib.CandidateNode, error) {
+	if mod.Expression != "" || (mod.JsonPatch != "" && mod.StrategicMergePatch != "") {
+		return nil, fmt.Errorf("modification must set only one of expression, jsonPatch and strategicMergePatch")
+	}
+	manifestYAML, err := m.encode(manifest)
+	if err != nil {
+		return nil, err
+	}
+	original, err := k8syaml.YAMLToJSON(manifestYAML)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	if mod.JsonPatch != "" {
+		patched, err = applyJsonPatch(original, mod.JsonPatch)
+	} else {
+		patched, err = applyStrategicMergePatch(original, mod.StrategicMergePatch, manifest)
+	}
+	if err != nil {
+		common.Log.Errorf("Failed to patch manifest of kind %s: %v", common.ManifestKind(manifest), err)
+		return nil, err
+	}
+
+	nodes, err := common.ExtractManifests(patched)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) != 1 {
+		return nil, fmt.Errorf("patch produced %d documents from manifest of kind %s", len(nodes), common.ManifestKind(manifest))
+	}
+	resetStyle(nodes[0])
+	retainLayout(manifest, nodes[0])
+	return nodes[0], nil
+}
+
+func applyJsonPatch(original []byte, patchYAML string) ([]byte, error) {
+	patchJSON, err := k8syaml.YAMLToJSON([]byte(patchYAML))
+	if err != nil {
+		return nil, err
+	}
+	operations, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		return nil, err
+	}
+	return operations.Apply(original)
+}
+
+// applyStrategicMergePatch merges the patch using the patch strategies (e.g. list items keyed by name) of the manifest's type,
+// the types not registered in the Kubernetes scheme are merged as JSON merge patch like kubectl does
+func applyStrategicMergePatch(original []byte, patchYAML string, manifest *yqlib.CandidateNode) ([]byte, error) {
+	patchJSON, err := k8syaml.YAMLToJSON([]byte(patchYAML))
+	if err != nil {
+		return nil, err
+	}
+	gvk := schema.FromAPIVersionAndKind(common.FieldValue(manifest, "apiVersion"), common.ManifestKind(manifest))
+	dataStruct, err := scheme.Scheme.New(gvk)
+	if runtime.IsNotRegisteredError(err) {
+		common.Log.Debugf("No patch strategies of %s, applying JSON merge patch", gvk)
+		return jsonpatch.MergePatch(original, patchJSON)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strategicpatch.StrategicMergePatch(original, patchJSON, dataStruct)
+}
+
+// resetStyle drops the JSON flow and quoting style of the patched manifest, leaving the style to the encoder
+func resetStyle(node *yqlib.CandidateNode) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetStyle(child)
+	}
+}
+
+// retainLayout restores the key order, comments and scalar styles of the original manifest on the patched one,
+// the keys added by the patch follow the original ones, the list items are matched by position when the list length is kept
+func retainLayout(original, patched *yqlib.CandidateNode) {
+	if original.Kind != patched.Kind {
+		return
+	}
+	patched.Style = original.Style
+	patched.HeadComment, patched.LineComment, patched.FootComment = original.HeadComment, original.LineComment, original.FootComment
+
+	switch patched.Kind {
+	case yqlib.MappingNode:
+		positions := make(map[string]int, len(original.Content)/2)
+		for i := 0; i+1 < len(original.Content); i += 2 {
+			positions[original.Content[i].Value] = i
+		}
+		type entry struct {
+			key, value *yqlib.CandidateNode
+			position   int
+		}
+		entries := make([]entry, 0, len(patched.Content)/2)
+		for i := 0; i+1 < len(patched.Content); i += 2 {
+			key, value := patched.Content[i], patched.Content[i+1]
+			position, found := positions[key.Value]
+			if found {
+				retainLayout(original.Content[position], key)
+				retainLayout(original.Content[position+1], value)
+			} else {
+				position = len(original.Content) + i
+			}
+			entries = append(entries, entry{key, value, position})
+		}
+		slices.SortStableFunc(entries, func(a, b entry) int { return a.position - b.position })
+		patched.Content = patched.Content[:0]
+		for _, e := range entries {
+			patched.Content = append(patched.Content, e.key, e.value)
+		}
+	case yqlib.SequenceNode:
+		if len(original.Content) == len(patched.Content) {
+			for i := range patched.Content {
+				retainLayout(original.Content[i], patched.Content[i])
+			}
+		}
+	case yqlib.ScalarNode:
+		if original.Value != patched.Value || original.Tag != patched.Tag {
+			patched.Style = 0
+		}
+	}
+}
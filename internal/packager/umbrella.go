@@ -0,0 +1,189 @@
+package packager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/kiemlicz/charter/internal/common"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// InitialUmbrellaVersion is the Version of newly created umbrella charts
+const InitialUmbrellaVersion = "0.1.0"
+
+// MergedCharts are the Chart.yaml files of the umbrella charts and their dependencies as merged into the default branch,
+// keyed by the chart's path, the charts not generated yet are missing
+type MergedCharts map[string]*chart.Metadata
+
+// PeekMergedCharts reads the umbrella charts and their dependencies in each of the charts directories (of the main and the release lines),
+// it must run before the update changes them
+func PeekMergedCharts(umbrellas []common.Umbrella, dirs []string) (MergedCharts, error) {
+	merged := make(MergedCharts)
+	for _, dir := range dirs {
+		for _, umbrella := range umbrellas {
+			names := []string{umbrella.Name}
+			for _, dependency := range umbrella.Dependencies {
+				names = append(names, dependency.Chart)
+			}
+			for _, name := range names {
+				chartPath := filepath.Join(dir, name)
+				metadata, err := chartutil.LoadChartfile(filepath.Join(chartPath, chartutil.ChartfileName))
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					common.Log.Errorf("Failed to load chart %s: %v", chartPath, err)
+					return nil, err
+				}
+				merged[chartPath] = metadata
+			}
+		}
+	}
+	return merged, nil
+}
+
+// UpdateUmbrellas syncs the umbrella charts depending on the updated charts with their new versions,
+// the other dependencies stay at their merged versions so that the umbrella charts, committed along with the updated charts, pin only the versions merged with them.
+// Returns the umbrella charts created or changed, saved to settings.SrcDir. The umbrella charts whose dependencies aren't generated yet are skipped.
+func UpdateUmbrellas(umbrellas []common.Umbrella, merged MergedCharts, charts *HelmizedManifests, settings *common.HelmSettings) ([]*chart.Chart, error) {
+	current := func(name string) *chart.Metadata {
+		if charts.Chart.Metadata.Name == name {
+			return charts.Chart.Metadata
+		}
+		if charts.CrdChart != nil && charts.CrdChart.Metadata.Name == name {
+			return charts.CrdChart.Metadata
+		}
+		return merged[filepath.Join(settings.SrcDir, name)]
+	}
+
+	updated := make([]*chart.Chart, 0)
+	for i := range umbrellas {
+		umbrella := &umbrellas[i]
+		dependsOnCharts := slices.ContainsFunc(umbrella.Dependencies, func(dependency common.UmbrellaDependency) bool {
+			return dependency.Chart == charts.Chart.Metadata.Name || (charts.CrdChart != nil && dependency.Chart == charts.CrdChart.Metadata.Name)
+		})
+		if !dependsOnCharts {
+			continue
+		}
+		umbrellaChart, err := updateUmbrella(umbrella, current, merged[filepath.Join(settings.SrcDir, umbrella.Name)], settings)
+		if err != nil {
+			return nil, err
+		}
+		if umbrellaChart != nil {
+			updated = append(updated, umbrellaChart)
+		}
+	}
+	return updated, nil
+}
+
+func updateUmbrella(umbrella *common.Umbrella, current func(name string) *chart.Metadata, existing *chart.Metadata, settings *common.HelmSettings) (*chart.Chart, error) {
+	if len(umbrella.Dependencies) == 0 {
+		return nil, fmt.Errorf("umbrella chart %s has no dependencies", umbrella.Name)
+	}
+	dependencies := make([]*chart.Dependency, 0, len(umbrella.Dependencies))
+	appVersion := ""
+	for i, dependency := range umbrella.Dependencies {
+		metadata := current(dependency.Chart)
+		if metadata == nil {
+			common.Log.Warnf("Dependency %s of umbrella chart %s doesn't exist (yet), skipping the umbrella chart", dependency.Chart, umbrella.Name)
+			return nil, nil
+		}
+		if i == 0 {
+			appVersion = metadata.AppVersion
+		}
+		dependencies = append(dependencies, &chart.Dependency{
+			Name:       dependency.Chart,
+			Version:    metadata.Version,
+			Repository: settings.Remote,
+			Condition:  dependency.Condition,
+		})
+	}
+
+	version := semver.MustParse(InitialUmbrellaVersion)
+	switch {
+	case existing == nil:
+		common.Log.Infof("Umbrella chart %s doesn't exist yet, will create it", umbrella.Name)
+	case reflect.DeepEqual(existing.Dependencies, dependencies) && existing.AppVersion == appVersion:
+		common.Log.Infof("Umbrella chart %s is up to date", umbrella.Name)
+		return nil, nil
+	default:
+		merged, err := semver.NewVersion(existing.Version)
+		if err != nil {
+			return nil, fmt.Errorf("umbrella chart %s has invalid version: %w", umbrella.Name, err)
+		}
+		bumped := merged.IncPatch()
+		version = &bumped
+	}
+
+	umbrellaChart := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion:   chart.APIVersionV2,
+			Name:         umbrella.Name,
+			Version:      version.String(),
+			AppVersion:   appVersion,
+			Description:  fmt.Sprintf("A Helm Chart for %s", umbrella.Name),
+			Type:         "application",
+			Dependencies: dependencies,
+		},
+	}
+	if err := umbrellaChart.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid umbrella chart %s: %w", umbrella.Name, err)
+	}
+	if err := os.MkdirAll(settings.SrcDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := chartutil.SaveDir(umbrellaChart, settings.SrcDir); err != nil {
+		common.Log.Errorf("Failed to save umbrella chart %s: %v", umbrella.Name, err)
+		return nil, err
+	}
+	common.Log.Infof("Updated umbrella chart %s to version %s", umbrella.Name, umbrellaChart.Metadata.Version)
+	return umbrellaChart, nil
+}
+
+// IsUmbrella tells whether the chart depends on other charts
+func IsUmbrella(chartPath string) (bool, error) {
+	metadata, err := chartutil.LoadChartfile(filepath.Join(chartPath, chartutil.ChartfileName))
+	if err != nil {
+		return false, err
+	}
+	return len(metadata.Dependencies) > 0, nil
+}
+
+// PackageUmbrella packages the umbrella chart with its dependencies vendored from the charts packaged to settings.TargetDir already
+func PackageUmbrella(chartPath string, settings *common.HelmSettings) (string, error) {
+	metadata, err := chartutil.LoadChartfile(filepath.Join(chartPath, chartutil.ChartfileName))
+	if err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp("", "charter-umbrella-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vendoredPath := filepath.Join(tmpDir, filepath.Base(chartPath))
+	if err := os.CopyFS(vendoredPath, os.DirFS(chartPath)); err != nil {
+		return "", err
+	}
+	chartsDir := filepath.Join(vendoredPath, chartutil.ChartsDir)
+	if err := os.MkdirAll(chartsDir, 0755); err != nil {
+		return "", err
+	}
+	for _, dependency := range metadata.Dependencies {
+		archive := fmt.Sprintf("%s-%s.tgz", dependency.Name, dependency.Version)
+		data, err := os.ReadFile(filepath.Join(settings.TargetDir, archive))
+		if err != nil {
+			return "", fmt.Errorf("dependency %s of umbrella chart %s isn't packaged: %w", dependency.Name, metadata.Name, err)
+		}
+		if err := os.WriteFile(filepath.Join(chartsDir, archive), data, 0644); err != nil {
+			return "", err
+		}
+	}
+	return Package(vendoredPath, settings)
+}
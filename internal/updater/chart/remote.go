@@ -0,0 +1,93 @@
+package chart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kiemlicz/charter/internal/common"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// load returns the source chart, pulling it first when a remote chart is configured.
+// The pulled chart archive is stored in the cache and read from it in offline mode.
+func (s *HelmChartSource) load() (*chart.Chart, error) {
+	if s.cfg.Chart == "" {
+		srcChart, err := loader.Load(s.cfg.SrcDir)
+		if err != nil {
+			return nil, fmt.Errorf("helmChartSource: failed to load source chart at %s: %w", s.cfg.SrcDir, err)
+		}
+		return srcChart, nil
+	}
+
+	archive, err := s.cache.Latest(func() ([]byte, error) {
+		destDir, err := os.MkdirTemp("", "charter-chart-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(destDir)
+
+		chartPath, err := pull(s.cfg.Repo, s.cfg.Chart, s.cfg.Version, destDir)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(chartPath)
+	}, "helm", s.cfg.Repo, s.cfg.Chart, s.cfg.Version)
+	if err != nil {
+		return nil, fmt.Errorf("helmChartSource: failed to pull source chart %s: %w", s.cfg.Chart, err)
+	}
+	srcChart, err := loader.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("helmChartSource: failed to load pulled chart %s: %w", s.cfg.Chart, err)
+	}
+	common.Log.Infof("HelmChart source %s: pulled %s in version %s", s.helm.ChartName, s.cfg.Chart, srcChart.Metadata.Version)
+	return srcChart, nil
+}
+
+// pull downloads the chart archive matching the version constraint into destDir, the same way `helm pull` does
+func pull(repoUrl, chartRef, versionConstraint, destDir string) (string, error) {
+	settings := cli.New()
+	rc, err := registry.NewClient(
+		registry.ClientOptEnableCache(true),
+	)
+	if err != nil {
+		common.Log.Errorf("failed to create registry client: %v", err)
+		return "", err
+	}
+
+	dl := downloader.ChartDownloader{
+		Out:              io.Discard,
+		Verify:           downloader.VerifyNever,
+		Getters:          getter.All(settings),
+		Options:          []getter.Option{getter.WithRegistryClient(rc)},
+		RegistryClient:   rc,
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+	}
+
+	ref := chartRef
+	if repoUrl != "" {
+		if registry.IsOCI(chartRef) {
+			return "", fmt.Errorf("chart %s is an OCI reference, repo must not be set", chartRef)
+		}
+		ref, err = repo.FindChartInRepoURL(repoUrl, chartRef, versionConstraint, "", "", "", dl.Getters)
+		if err != nil {
+			return "", err
+		}
+	} else if !registry.IsOCI(chartRef) {
+		return "", fmt.Errorf("chart %s must be an oci:// reference or repo must be set", chartRef)
+	}
+
+	chartPath, _, err := dl.DownloadTo(ref, versionConstraint, destDir)
+	if err != nil {
+		return "", err
+	}
+	return chartPath, nil
+}
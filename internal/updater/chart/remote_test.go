@@ -0,0 +1,153 @@
+package chart
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// newTestRepo serves the index.yaml and archives of the testdata chart packaged in each of the versions
+func newTestRepo(t *testing.T, versions ...string) *httptest.Server {
+	t.Helper()
+	// helm's repository cache and config mustn't be the user's
+	t.Setenv("HELM_CACHE_HOME", t.TempDir())
+	t.Setenv("HELM_CONFIG_HOME", t.TempDir())
+	t.Setenv("HELM_DATA_HOME", t.TempDir())
+
+	srcChart, err := loader.Load("testdata/operator")
+	if err != nil {
+		t.Fatalf("failed to load chart: %v", err)
+	}
+	repoDir := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	t.Cleanup(server.Close)
+
+	index := repo.NewIndexFile()
+	for _, version := range versions {
+		srcChart.Metadata.Version = version
+		srcChart.Metadata.AppVersion = "v" + version
+		archive, err := chartutil.Save(srcChart, repoDir)
+		if err != nil {
+			t.Fatalf("failed to package chart: %v", err)
+		}
+		digest, err := provenance.DigestFile(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := *srcChart.Metadata
+		if err := index.MustAdd(&metadata, filepath.Base(archive), server.URL, digest); err != nil {
+			t.Fatalf("failed to index chart: %v", err)
+		}
+	}
+	if err := index.WriteFile(filepath.Join(repoDir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("failed to write index: %v", err)
+	}
+	return server
+}
+
+func TestFetchRemote(t *testing.T) {
+	server := newTestRepo(t, "1.1.0", "1.2.0", "2.0.0", "2.1.0-rc.0")
+	tests := []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{"newest", "", "2.0.0"},
+		{"exact", "1.1.0", "1.1.0"},
+		{"constraint", "~1", "1.2.0"},
+		{"range", ">=1.1 <2", "1.2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			source := NewHelmChartSource(nil, &common.HelmChartSourceConfig{
+				Repo:    server.URL,
+				Chart:   "operator",
+				Version: tt.version,
+				Mode:    common.HelmChartModeRender,
+			}, &common.HelmOps{ChartName: "operator"})
+
+			//when
+			manifests, err := source.Fetch(context.Background(), "", "")
+
+			//then
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if manifests.Version.String() != tt.want || manifests.AppVersion != "v"+tt.want {
+				t.Errorf("Fetch() version = %s, appVersion = %s, want %s pulled", manifests.Version.String(), manifests.AppVersion, tt.want)
+			}
+			if len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+				t.Errorf("Fetch() manifests = %d, crds = %d, want 1, 1", len(manifests.Manifests), len(manifests.Crds))
+			}
+		})
+	}
+}
+
+func TestFetchRemoteNoMatchingVersion(t *testing.T) {
+	//given
+	server := newTestRepo(t, "1.1.0", "1.2.0")
+	source := NewHelmChartSource(nil, &common.HelmChartSourceConfig{
+		Repo:    server.URL,
+		Chart:   "operator",
+		Version: ">=3",
+	}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	_, err := source.Fetch(context.Background(), "", "")
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), "failed to pull") {
+		t.Errorf("Fetch() error = %v, want pull error for version constraint matching nothing", err)
+	}
+}
+
+func TestFetchRemoteCached(t *testing.T) {
+	//given
+	server := newTestRepo(t, "1.1.0", "1.2.0")
+	cacheDir := t.TempDir()
+	cfg := common.HelmChartSourceConfig{Repo: server.URL, Chart: "operator", Version: "~1", Mode: common.HelmChartModeRender}
+	if _, err := NewHelmChartSource(common.NewCache(cacheDir, false), &cfg, &common.HelmOps{ChartName: "operator"}).Fetch(context.Background(), "", ""); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	server.Close()
+
+	//when
+	manifests, err := NewHelmChartSource(common.NewCache(cacheDir, true), &cfg, &common.HelmOps{ChartName: "operator"}).Fetch(context.Background(), "", "")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() offline error = %v", err)
+	}
+	if manifests.Version.String() != "1.2.0" {
+		t.Errorf("Fetch() offline version = %s, want the cached 1.2.0", manifests.Version.String())
+	}
+}
+
+func TestPullInvalidReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoUrl  string
+		chartRef string
+	}{
+		{"oci reference with repo", "https://charts.example.com", "oci://registry.example.com/charts/operator"},
+		{"chart name without repo", "", "operator"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := pull(tt.repoUrl, tt.chartRef, "", os.TempDir()); err == nil {
+				t.Errorf("pull() expected error for %s", tt.chartRef)
+			}
+		})
+	}
+}
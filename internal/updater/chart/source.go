@@ -1,43 +1,56 @@
-// Package chart provides a ManifestSource that extracts CRDs from an existing
-// Helm chart's crds/ directory and packages them into a separate chart.
+// Package chart provides a ManifestSource that produces manifests from an existing
+// Helm chart: either extracts CRDs from its crds/ directory (to package them into a separate chart)
+// or renders the whole chart (to re-parametrize it with the regular modifications).
 package chart
 
 import (
 	"context"
 	"fmt"
-	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/kiemlicz/charter/internal/common"
-	"helm.sh/helm/v3/pkg/chart/loader"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
 )
 
-// HelmChartSource implements common.ManifestSource by reading CRD YAML files
-// from the crds/ sub-directory of an existing Helm chart.
-// The resulting Manifests contain only the CRD documents as regular manifests
+// HelmChartSource implements common.ManifestSource backed by an existing Helm chart, local or remote.
+// In the crds mode the resulting Manifests contain only the CRD documents as regular manifests
 // (not in the Crds split), so that Prepare creates a single flat CRD chart
 // using the helmOps.ChartName (e.g. "kubevirt-crds").
+// In the render mode the rendered templates (and CRDs) are split like any other upstream manifests.
 type HelmChartSource struct {
-	cfg  *common.HelmChartSourceConfig
-	helm *common.HelmOps
+	cache *common.Cache
+	cfg   *common.HelmChartSourceConfig
+	helm  *common.HelmOps
 }
 
-// NewHelmChartSource constructs a HelmChartSource.
-func NewHelmChartSource(cfg *common.HelmChartSourceConfig, helm *common.HelmOps) *HelmChartSource {
-	return &HelmChartSource{cfg: cfg, helm: helm}
+func init() {
+	common.RegisterSource(common.SourceTypeHelmChart, common.SourceTraits{},
+		func(cfg *common.HelmChartSourceConfig, _ *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			return NewHelmChartSource(env.Cache, cfg, helm), nil
+		})
+}
+
+// NewHelmChartSource constructs a HelmChartSource, remote charts are pulled through the cache.
+func NewHelmChartSource(cache *common.Cache, cfg *common.HelmChartSourceConfig, helm *common.HelmOps) *HelmChartSource {
+	return &HelmChartSource{cache: cache, cfg: cfg, helm: helm}
 }
 
 func (s *HelmChartSource) ChartName() string        { return s.helm.ChartName }
 func (s *HelmChartSource) HelmOps() *common.HelmOps { return s.helm }
 
-// Fetch loads CRD manifests from the source chart's crds/ directory.
+// Fetch loads manifests from the source chart according to the configured mode.
 // Returns (nil, nil) when the existing generated chart already matches the
 // source chart's AppVersion (or Version when AppVersion is empty).
 func (s *HelmChartSource) Fetch(_ context.Context, _, existingAppVersion string) (*common.Manifests, error) {
-	srcChart, err := loader.Load(s.cfg.SrcDir)
+	srcChart, err := s.load()
 	if err != nil {
-		return nil, fmt.Errorf("helmChartSource: failed to load source chart at %s: %w", s.cfg.SrcDir, err)
+		return nil, err
 	}
 
 	// Use AppVersion as the upstream identity string; fall back to Version.
@@ -55,32 +68,35 @@ func (s *HelmChartSource) Fetch(_ context.Context, _, existingAppVersion string)
 		return nil, fmt.Errorf("helmChartSource: source chart version %q is not valid SemVer: %w", srcChart.Metadata.Version, err)
 	}
 
-	crdsDir := filepath.Join(s.cfg.SrcDir, "crds")
-	entries, err := os.ReadDir(crdsDir)
-	if err != nil {
-		return nil, fmt.Errorf("helmChartSource: cannot read crds/ directory %s: %w", crdsDir, err)
+	switch s.cfg.Mode {
+	case common.HelmChartModeCrds, "":
+		return s.crds(srcChart, chartVersion, remoteAppVersion)
+	case common.HelmChartModeRender:
+		return s.render(srcChart, chartVersion, remoteAppVersion)
+	default:
+		return nil, fmt.Errorf("helmChartSource: unknown mode: %q", s.cfg.Mode)
 	}
+}
 
-	manifests := make([]map[string]any, 0)
-	for _, entry := range entries {
-		if entry.IsDir() {
+func (s *HelmChartSource) crds(srcChart *chart.Chart, chartVersion *semver.Version, remoteAppVersion string) (*common.Manifests, error) {
+	manifests := make([]*yqlib.CandidateNode, 0)
+	for _, file := range srcChart.Files {
+		if path.Dir(file.Name) != "crds" {
 			continue
 		}
-		name := entry.Name()
-		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+		if ext := path.Ext(file.Name); ext != ".yaml" && ext != ".yml" {
 			continue
 		}
-		data, err := os.ReadFile(filepath.Join(crdsDir, name))
-		if err != nil {
-			return nil, fmt.Errorf("helmChartSource: failed to read %s: %w", name, err)
-		}
-		docs, err := common.ExtractYamls(data)
+		docs, err := common.ExtractManifests(file.Data)
 		if err != nil {
-			return nil, fmt.Errorf("helmChartSource: failed to parse %s: %w", name, err)
+			return nil, fmt.Errorf("helmChartSource: failed to parse %s: %w", file.Name, err)
 		}
-		manifests = append(manifests, *docs...)
+		manifests = append(manifests, docs...)
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("helmChartSource: no CRD documents found in crds/ directory of %s", srcChart.Name())
 	}
-	common.Log.Infof("HelmChart source %s: read %d CRD documents from %s", s.helm.ChartName, len(manifests), crdsDir)
+	common.Log.Infof("HelmChart source %s: read %d CRD documents from %s/crds", s.helm.ChartName, len(manifests), srcChart.Name())
 
 	addValues := s.helm.AddValues
 	if addValues == nil {
@@ -91,10 +107,65 @@ func (s *HelmChartSource) Fetch(_ context.Context, _, existingAppVersion string)
 		// Place docs in Manifests (not Crds) so Prepare builds them as
 		// regular templates in the named chart without an additional split.
 		Manifests:  manifests,
-		Crds:       []map[string]any{},
+		Crds:       []*yqlib.CandidateNode{},
 		Version:    *chartVersion,
 		AppVersion: remoteAppVersion,
 		Values:     addValues,
 		CrdsValues: map[string]any{},
 	}, nil
 }
+
+// render renders the source chart templates the same way `helm template` does (without a cluster)
+func (s *HelmChartSource) render(srcChart *chart.Chart, chartVersion *semver.Version, remoteAppVersion string) (*common.Manifests, error) {
+	values := chartutil.Values{}
+	if s.cfg.ValuesFile != "" {
+		var err error
+		values, err = chartutil.ReadValuesFile(s.cfg.ValuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("helmChartSource: failed to read values file %s: %w", s.cfg.ValuesFile, err)
+		}
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(srcChart, values); err != nil {
+		return nil, fmt.Errorf("helmChartSource: failed to process dependencies of %s: %w", srcChart.Name(), err)
+	}
+
+	releaseName := s.cfg.ReleaseName
+	if releaseName == "" {
+		releaseName = s.helm.ChartName
+	}
+	namespace := s.cfg.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	options := chartutil.ReleaseOptions{
+		Name:      releaseName,
+		Namespace: namespace,
+		Revision:  1,
+		IsInstall: true,
+	}
+	renderValues, err := chartutil.ToRenderValues(srcChart, values, options, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, fmt.Errorf("helmChartSource: failed to compute render values for %s: %w", srcChart.Name(), err)
+	}
+	rendered, err := engine.Render(srcChart, renderValues)
+	if err != nil {
+		return nil, fmt.Errorf("helmChartSource: failed to render %s: %w", srcChart.Name(), err)
+	}
+
+	assetsData := make(map[string][]byte)
+	for _, crd := range srcChart.CRDObjects() {
+		assetsData[crd.Filename] = crd.File.Data
+	}
+	for name, content := range rendered {
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+			continue // NOTES.txt and partials
+		}
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		assetsData[name] = []byte(content)
+	}
+	common.Log.Infof("HelmChart source %s: rendered %d files from %s", s.helm.ChartName, len(assetsData), srcChart.Name())
+
+	return common.NewManifests(&assetsData, chartVersion, remoteAppVersion, &s.helm.AddValues, &s.helm.AddCrdValues)
+}
@@ -0,0 +1,105 @@
+package chart
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestFetchRender(t *testing.T) {
+	tests := []struct {
+		name       string
+		valuesFile string
+		want       []string
+		replicas   string
+	}{
+		{"chart values", "", []string{"Deployment/operator-system/operator"}, "1"},
+		{"values file", "testdata/values-webhook.yaml", []string{"Deployment/operator-system/operator", "Service/operator-system/operator-webhook"}, "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			source := NewHelmChartSource(nil, &common.HelmChartSourceConfig{
+				SrcDir:     "testdata/operator",
+				Mode:       common.HelmChartModeRender,
+				ValuesFile: tt.valuesFile,
+				Namespace:  "operator-system",
+			}, &common.HelmOps{ChartName: "operator"})
+
+			//when
+			manifests, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+			//then
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+				t.Errorf("Fetch() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+			}
+			names := make([]string, 0, len(manifests.Manifests))
+			for _, manifest := range manifests.Manifests {
+				names = append(names, common.ManifestKind(manifest)+"/"+common.FieldValue(manifest, "metadata", "namespace")+"/"+common.FieldValue(manifest, "metadata", "name"))
+				if common.ManifestKind(manifest) == "Deployment" {
+					if replicas := common.FieldValue(manifest, "spec", "replicas"); replicas != tt.replicas {
+						t.Errorf("Fetch() replicas = %s, want %s", replicas, tt.replicas)
+					}
+					if label := common.FieldValue(manifest, "metadata", "labels", "app.kubernetes.io/instance"); label != "operator" {
+						t.Errorf("Fetch() instance label = %s, want the release name rendered by the helper", label)
+					}
+				}
+			}
+			slices.Sort(names)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Fetch() manifests = %v, want %v", names, tt.want)
+			}
+			if len(manifests.Crds) != 1 || common.FieldValue(manifests.Crds[0], "metadata", "name") != "things.example.com" {
+				t.Errorf("Fetch() crds = %d, want the chart's CRD split out", len(manifests.Crds))
+			}
+		})
+	}
+}
+
+func TestFetchCrds(t *testing.T) {
+	//given
+	source := NewHelmChartSource(nil, &common.HelmChartSourceConfig{
+		SrcDir: "testdata/operator",
+		Mode:   common.HelmChartModeCrds,
+	}, &common.HelmOps{ChartName: "operator-crds"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "", "")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if len(manifests.Manifests) != 1 || len(manifests.Crds) != 0 || common.ManifestKind(manifests.Manifests[0]) != "CustomResourceDefinition" {
+		t.Errorf("Fetch() manifests = %d, crds = %d, want the single CRD as a regular manifest", len(manifests.Manifests), len(manifests.Crds))
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	source := NewHelmChartSource(nil, &common.HelmChartSourceConfig{
+		SrcDir: "testdata/operator",
+		Mode:   common.HelmChartModeRender,
+	}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil || manifests != nil {
+		t.Errorf("Fetch() = %v, %v, want nil for an up to date chart", manifests, err)
+	}
+}
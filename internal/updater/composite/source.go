@@ -0,0 +1,243 @@
+// Package composite provides a ManifestSource combining the manifests of several child sources into a single chart.
+package composite
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/kiemlicz/charter/internal/packager"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+const (
+	// VersionMax derives the chart's Version from the highest version of the children
+	VersionMax = "max"
+)
+
+var (
+	childNameRegex      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	templateActionRegex = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+	// valuesRegex matches the .Values references of template actions (.Values.x, bare .Values and $.Values), not the fields of variables
+	valuesRegex = regexp.MustCompile(`(^|[^\w])\.Values\b`)
+)
+
+type child struct {
+	index  int
+	name   string
+	spec   *common.CompositeChild
+	helm   *common.HelmOps
+	source common.ManifestSource
+}
+
+// CompositeSource implements common.ManifestSource combining the manifests of its children.
+type CompositeSource struct {
+	cfg      *common.CompositeSourceConfig
+	helm     *common.HelmOps
+	env      *common.SourceEnv
+	children []child
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeComposite, common.SourceTraits{},
+		func(cfg *common.CompositeSourceConfig, _ *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			return NewCompositeSource(env, cfg, helm)
+		})
+}
+
+// NewCompositeSource constructs a CompositeSource, its children are created from their source entries like top-level sources, sharing the env.
+func NewCompositeSource(env *common.SourceEnv, cfg *common.CompositeSourceConfig, helm *common.HelmOps) (*CompositeSource, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, fmt.Errorf("composite source of %s has no sources", helm.ChartName)
+	}
+
+	children := make([]child, 0, len(cfg.Sources))
+	names := make(map[string]bool, len(cfg.Sources))
+	for i := range cfg.Sources {
+		spec := &cfg.Sources[i]
+		if !childNameRegex.MatchString(spec.Name) {
+			return nil, fmt.Errorf("child %d of %s has invalid name %q, must be an identifier", i, helm.ChartName, spec.Name)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("child %s of %s is defined twice", spec.Name, helm.ChartName)
+		}
+		names[spec.Name] = true
+		for _, mod := range spec.Helm.Modifications {
+			if mod.TextRegex != "" {
+				return nil, fmt.Errorf("child %s of %s has textRegex modification, these apply to the composite's templates only", spec.Name, helm.ChartName)
+			}
+		}
+		if len(spec.Helm.Optional) > 0 {
+			return nil, fmt.Errorf("child %s of %s has optional resources, these apply to the composite's templates only", spec.Name, helm.ChartName)
+		}
+
+		childHelm := spec.Helm
+		if childHelm.ChartName == "" {
+			childHelm.ChartName = fmt.Sprintf("%s/%s", helm.ChartName, spec.Name)
+		}
+		source, err := common.NewSource(i, &spec.SourceSpec, &spec.Release, &childHelm, env)
+		if err != nil {
+			return nil, fmt.Errorf("child %s of %s: %w", spec.Name, helm.ChartName, err)
+		}
+		children = append(children, child{index: i, name: spec.Name, spec: spec, helm: &childHelm, source: source})
+	}
+	if cfg.Version != "" && cfg.Version != VersionMax && !names[cfg.Version] {
+		return nil, fmt.Errorf("composite source of %s follows version of unknown child %q", helm.ChartName, cfg.Version)
+	}
+
+	return &CompositeSource{cfg: cfg, helm: helm, env: env, children: children}, nil
+}
+
+func (s *CompositeSource) ChartName() string        { return s.helm.ChartName }
+func (s *CompositeSource) HelmOps() *common.HelmOps { return s.helm }
+
+// Fetch checks every child against its version recorded in the existing AppVersion, when any of them changed
+// the manifests of all children are combined, the unchanged children are fetched at their recorded versions.
+// Returns (nil, nil) when none of the children changed.
+func (s *CompositeSource) Fetch(ctx context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	previous := parseAppVersion(existingAppVersion)
+	fetched := make([]*common.Manifests, len(s.children))
+	changed := false
+	for i, c := range s.children {
+		manifests, err := c.source.Fetch(ctx, "", previous[c.name])
+		if err != nil {
+			return nil, fmt.Errorf("child %s of %s failed: %w", c.name, s.helm.ChartName, err)
+		}
+		fetched[i] = manifests
+		changed = changed || manifests != nil
+	}
+	if !changed {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	combined := &common.Manifests{
+		Crds:       make([]*yqlib.CandidateNode, 0),
+		Manifests:  make([]*yqlib.CandidateNode, 0),
+		Values:     s.helm.AddValues,
+		CrdsValues: s.helm.AddCrdValues,
+	}
+	appVersions := make([]string, 0, len(s.children))
+	for i, c := range s.children {
+		if fetched[i] == nil {
+			// unchanged child, its manifests are part of the chart anyway
+			manifests, err := s.fetchRecorded(ctx, &c, previous[c.name])
+			if err != nil {
+				return nil, err
+			}
+			fetched[i] = manifests
+		}
+		if err := c.add(combined, fetched[i]); err != nil {
+			return nil, err
+		}
+		appVersions = append(appVersions, fmt.Sprintf("%s=%s", c.name, fetched[i].AppVersion))
+	}
+
+	version, err := s.version(existingVersion, fetched)
+	if err != nil {
+		return nil, err
+	}
+	combined.Version = *version
+	combined.AppVersion = strings.Join(appVersions, ",")
+	common.Log.Infof("Combined %d sources of %s, version: %s, appVersion: %s", len(s.children), s.helm.ChartName, version, combined.AppVersion)
+	return combined, nil
+}
+
+// fetchRecorded fetches the manifests of the child's release recorded in the existing AppVersion,
+// the child's source is created again with its release policy pinned to the recorded release
+func (s *CompositeSource) fetchRecorded(ctx context.Context, c *child, appVersion string) (*common.Manifests, error) {
+	pinned := c.spec.Release
+	pinned.Pin = appVersion
+	source, err := common.NewSource(c.index, &c.spec.SourceSpec, &pinned, c.helm, s.env)
+	if err != nil {
+		return nil, fmt.Errorf("child %s of %s: %w", c.name, s.helm.ChartName, err)
+	}
+	manifests, err := source.Fetch(ctx, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("child %s of %s failed to fetch recorded release %s: %w", c.name, s.helm.ChartName, appVersion, err)
+	}
+	if manifests == nil {
+		return nil, fmt.Errorf("child %s of %s returned no manifests", c.name, s.helm.ChartName)
+	}
+	if manifests.AppVersion != appVersion {
+		return nil, fmt.Errorf("child %s of %s fetched release %s instead of the recorded %s", c.name, s.helm.ChartName, manifests.AppVersion, appVersion)
+	}
+	return manifests, nil
+}
+
+// add applies the child's drops and modifications to its manifests and adds them to the combined ones,
+// the child's values (and references to them) are nested under the child's name
+func (c *child) add(combined *common.Manifests, manifests *common.Manifests) error {
+	filtered, err := packager.ChartModifier.FilterManifests(manifests, c.helm.Drop, c.helm.DropSelectors)
+	if err != nil {
+		return fmt.Errorf("failed to filter manifests of child %s: %w", c.name, err)
+	}
+	modified, err := packager.ChartModifier.ParametrizeManifests(c.helm.ChartName, filtered, &c.helm.Modifications)
+	if err != nil {
+		return fmt.Errorf("failed to modify manifests of child %s: %w", c.name, err)
+	}
+
+	for _, manifest := range modified.Manifests {
+		nestValues(manifest, c.name)
+		combined.Manifests = append(combined.Manifests, manifest)
+	}
+	for _, crd := range modified.Crds {
+		nestValues(crd, c.name)
+		combined.Crds = append(combined.Crds, crd)
+	}
+	if len(modified.Values) > 0 {
+		combined.Values = *common.DeepMerge(&combined.Values, &map[string]any{c.name: modified.Values})
+	}
+	if len(modified.CrdsValues) > 0 {
+		combined.CrdsValues = *common.DeepMerge(&combined.CrdsValues, &map[string]any{c.name: modified.CrdsValues})
+	}
+	return nil
+}
+
+// version derives the chart's Version from the followed child, bumping the existing Version's patch when the derived one isn't newer
+func (s *CompositeSource) version(existingVersion string, fetched []*common.Manifests) (*semver.Version, error) {
+	var derived *semver.Version
+	for i, c := range s.children {
+		v := &fetched[i].Version
+		if s.cfg.Version == c.name || ((s.cfg.Version == "" || s.cfg.Version == VersionMax) && (derived == nil || v.GreaterThan(derived))) {
+			derived = v
+		}
+	}
+	if derived == nil {
+		return nil, fmt.Errorf("no version derived for %s", s.helm.ChartName)
+	}
+
+	existing, err := semver.NewVersion(existingVersion)
+	if err != nil || derived.GreaterThan(existing) {
+		return derived, nil
+	}
+	bumped := existing.IncPatch()
+	common.Log.Infof("Derived version %s of %s isn't newer than existing %s, using %s", derived, s.helm.ChartName, existing, &bumped)
+	return &bumped, nil
+}
+
+// parseAppVersion reads the children's versions from the "name=version,..." AppVersion
+func parseAppVersion(appVersion string) map[string]string {
+	versions := make(map[string]string)
+	for _, entry := range strings.Split(appVersion, ",") {
+		if name, version, found := strings.Cut(entry, "="); found {
+			versions[strings.TrimSpace(name)] = strings.TrimSpace(version)
+		}
+	}
+	return versions
+}
+
+// nestValues rewrites .Values references within the templates of the node to the child's values
+func nestValues(node *yqlib.CandidateNode, name string) {
+	if node.Kind == yqlib.ScalarNode {
+		node.Value = templateActionRegex.ReplaceAllStringFunc(node.Value, func(action string) string {
+			return valuesRegex.ReplaceAllString(action, "${1}.Values."+name)
+		})
+	}
+	for _, child := range node.Content {
+		nestValues(child, name)
+	}
+}
@@ -0,0 +1,258 @@
+package composite
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+const testSourceType common.SourceType = "static"
+
+// staticConfig configures the static test source serving a single manifest of the given appVersion
+type staticConfig struct {
+	AppVersion string `koanf:"appVersion"`
+	Manifest   string `koanf:"manifest"`
+}
+
+// staticSource serves the release pinned by its policy in place of the configured appVersion, like versioned sources,
+// every Fetch is recorded in fetches as "chartName@pin"
+type staticSource struct {
+	cfg     *staticConfig
+	release *common.ReleasePolicy
+	helm    *common.HelmOps
+}
+
+var fetches []string
+
+func (s *staticSource) ChartName() string        { return s.helm.ChartName }
+func (s *staticSource) HelmOps() *common.HelmOps { return s.helm }
+func (s *staticSource) Fetch(_ context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	fetches = append(fetches, s.helm.ChartName+"@"+s.release.Pin)
+	appVersion := s.cfg.AppVersion
+	if s.release.Pin != "" {
+		appVersion = s.release.Pin
+	}
+	if existingAppVersion == appVersion {
+		return nil, nil
+	}
+	version, err := common.TakeNewerVersion(existingVersion, appVersion)
+	if err != nil {
+		return nil, err
+	}
+	assets := map[string][]byte{"manifest.yaml": []byte(s.cfg.Manifest)}
+	return common.NewManifests(&assets, version, appVersion, &s.helm.AddValues, &s.helm.AddCrdValues)
+}
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	common.RegisterSource(testSourceType, common.SourceTraits{},
+		func(cfg *staticConfig, release *common.ReleasePolicy, helm *common.HelmOps, _ *common.SourceEnv) (common.ManifestSource, error) {
+			return &staticSource{cfg: cfg, release: release, helm: helm}, nil
+		})
+	os.Exit(m.Run())
+}
+
+func TestFetch(t *testing.T) {
+	//given
+	source := newTestComposite(t, "kubevirt", "v1.6.0", "v1.62.0")
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "", "")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests.AppVersion != "kubevirt=v1.6.0,cdi=v1.62.0" || manifests.Version.String() != "1.6.0" {
+		t.Errorf("Fetch() version = %s, appVersion = %s, want 1.6.0, kubevirt=v1.6.0,cdi=v1.62.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	if len(manifests.Manifests) != 2 || len(manifests.Crds) != 1 {
+		t.Fatalf("Fetch() manifests = %d, crds = %d, want 2, 1", len(manifests.Manifests), len(manifests.Crds))
+	}
+	if replicas := common.FieldValue(manifests.Manifests[0], "spec", "replicas"); replicas != "{{ .Values.kubevirt.operator.replicas }}" {
+		t.Errorf("Fetch() replicas = %v, want reference to values nested under the child", replicas)
+	}
+	kubevirtValues, _ := manifests.Values["kubevirt"].(map[string]any)
+	if operator, _ := kubevirtValues["operator"].(map[string]any); operator["replicas"] != 2 {
+		t.Errorf("Fetch() values = %v, want kubevirt.operator.replicas: 2", manifests.Values)
+	}
+	if manifests.Values["shared"] != true {
+		t.Errorf("Fetch() values = %v, want composite's values kept", manifests.Values)
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	source := newTestComposite(t, "kubevirt", "v1.6.0", "v1.62.0")
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.6.0", "kubevirt=v1.6.0,cdi=v1.62.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests != nil {
+		t.Errorf("Fetch() = %v, want nil when no child changed", manifests)
+	}
+}
+
+func TestFetchChildChanged(t *testing.T) {
+	tests := []struct {
+		name            string
+		versionFrom     string
+		existingVersion string
+		wantVersion     string
+	}{
+		{"followed child unchanged", "kubevirt", "1.6.0", "1.6.1"},
+		{"max of children", "", "1.6.0", "1.62.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			source := newTestComposite(t, tt.versionFrom, "v1.6.0", "v1.62.0")
+
+			//when
+			manifests, err := source.Fetch(context.Background(), tt.existingVersion, "kubevirt=v1.6.0,cdi=v1.61.0")
+
+			//then
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if manifests == nil {
+				t.Fatalf("Fetch() returned no manifests when a child changed")
+			}
+			if manifests.Version.String() != tt.wantVersion {
+				t.Errorf("Fetch() version = %s, want %s", manifests.Version.String(), tt.wantVersion)
+			}
+			if len(manifests.Manifests) != 2 {
+				t.Errorf("Fetch() manifests = %d, want manifests of both children", len(manifests.Manifests))
+			}
+		})
+	}
+}
+
+func TestFetchUnchangedChildPinned(t *testing.T) {
+	//given
+	source := newTestComposite(t, "kubevirt", "v1.6.0", "v1.62.0")
+	fetches = nil
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.5.0", "kubevirt=v1.5.0,cdi=v1.62.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests.AppVersion != "kubevirt=v1.6.0,cdi=v1.62.0" {
+		t.Errorf("Fetch() appVersion = %s, want kubevirt=v1.6.0,cdi=v1.62.0", manifests.AppVersion)
+	}
+	if expected := "stack/kubevirt@,stack/cdi@,stack/cdi@v1.62.0"; strings.Join(fetches, ",") != expected {
+		t.Errorf("Fetch() fetched %v, want the unchanged child fetched pinned to its recorded release: %s", fetches, expected)
+	}
+}
+
+func TestNestValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"values key", "{{ .Values.operator.replicas }}", "{{ .Values.cdi.operator.replicas }}"},
+		{"bare values", "{{ toYaml .Values | nindent 4 }}", "{{ toYaml .Values.cdi | nindent 4 }}"},
+		{"with values", "{{- with .Values }}{{ .replicas }}{{ end }}", "{{- with .Values.cdi }}{{ .replicas }}{{ end }}"},
+		{"root values", "{{ $.Values.operator.replicas }}", "{{ $.Values.cdi.operator.replicas }}"},
+		{"no spaces", "{{.Values}}", "{{.Values.cdi}}"},
+		{"parenthesized", "{{ (.Values.operator).replicas }}", "{{ (.Values.cdi.operator).replicas }}"},
+		{"variable field", "{{ $config.Values.replicas }}", "{{ $config.Values.replicas }}"},
+		{"other field", "{{ .ValuesFile }}", "{{ .ValuesFile }}"},
+		{"outside of action", ".Values.operator {{ .Release.Name }}", ".Values.operator {{ .Release.Name }}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			node := &yqlib.CandidateNode{Kind: yqlib.ScalarNode, Tag: "!!str", Value: tt.value}
+
+			//when
+			nestValues(node, "cdi")
+
+			//then
+			if node.Value != tt.want {
+				t.Errorf("nestValues() = %s, want %s", node.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCompositeSourceInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  common.CompositeSourceConfig
+	}{
+		{"no sources", common.CompositeSourceConfig{}},
+		{"invalid name", common.CompositeSourceConfig{Sources: []common.CompositeChild{staticChild("kube-virt", "v1", "")}}},
+		{"duplicate name", common.CompositeSourceConfig{Sources: []common.CompositeChild{staticChild("cdi", "v1", ""), staticChild("cdi", "v2", "")}}},
+		{"unknown version child", common.CompositeSourceConfig{Version: "kubevirt", Sources: []common.CompositeChild{staticChild("cdi", "v1", "")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCompositeSource(nil, &tt.cfg, &common.HelmOps{ChartName: "stack"}); err == nil {
+				t.Errorf("NewCompositeSource() expected error")
+			}
+		})
+	}
+}
+
+func newTestComposite(t *testing.T, versionFrom, kubevirtVersion, cdiVersion string) *CompositeSource {
+	t.Helper()
+	kubevirt := staticChild("kubevirt", kubevirtVersion, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: virt-operator
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: virt-operator
+`)
+	kubevirt.Helm.Modifications = []common.Modification{{
+		Expression:     `.spec.replicas |= "{{ .Values.operator.replicas }}"`,
+		ValuesSelector: []string{".spec.replicas"},
+		Kind:           "Deployment",
+	}}
+	cdi := staticChild("cdi", cdiVersion, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: cdi-operator
+spec:
+  selector:
+    matchLabels:
+      app: cdi-operator
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: cdis.cdi.kubevirt.io
+`)
+	cfg := common.CompositeSourceConfig{Version: versionFrom, Sources: []common.CompositeChild{kubevirt, cdi}}
+	source, err := NewCompositeSource(nil, &cfg, &common.HelmOps{ChartName: "stack", AddValues: map[string]any{"shared": true}})
+	if err != nil {
+		t.Fatalf("NewCompositeSource() error = %v", err)
+	}
+	return source
+}
+
+func staticChild(name, appVersion, manifest string) common.CompositeChild {
+	return common.CompositeChild{
+		Name: name,
+		SourceSpec: common.SourceSpec{
+			Type:   testSourceType,
+			Blocks: map[string]any{string(testSourceType): map[string]any{"appVersion": appVersion, "manifest": manifest}},
+		},
+	}
+}
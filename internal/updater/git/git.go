@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -129,8 +130,9 @@ func (g *Client) CreateBranch(defaultBranch, branchName string) error {
 }
 
 // Commit commits all charts from
-// charts.Path/{charts.Chart.Metadata.Name} and
-// charts.Path/crds/{charts.CrdChart.Metadata.Name}
+// charts.Path/{charts.Chart.Metadata.Name},
+// charts.Path/crds/{charts.CrdChart.Metadata.Name} and
+// charts.Path/{umbrella.Metadata.Name} of charts.Umbrellas
 func (g *Client) Commit(charts *packager.HelmizedManifests) error {
 	wt, err := g.Repository.Worktree()
 	if err != nil {
@@ -142,8 +144,12 @@ func (g *Client) Commit(charts *packager.HelmizedManifests) error {
 	if charts.CrdChart != nil {
 		crdsChartPath = fmt.Sprintf("%s/%s", charts.Path, charts.CrdChart.Metadata.Name)
 	}
+	umbrellaPaths := make([]string, 0, len(charts.Umbrellas))
+	for _, umbrella := range charts.Umbrellas {
+		umbrellaPaths = append(umbrellaPaths, fmt.Sprintf("%s/%s", charts.Path, umbrella.Metadata.Name))
+	}
 
-	err = g.unstage(wt, chartPath, crdsChartPath)
+	err = g.unstage(wt, append([]string{chartPath, crdsChartPath}, umbrellaPaths...)...)
 	if err != nil {
 		return fmt.Errorf("failed to unstage files irrelevant to: %s, due to: %v", charts.Path, err)
 	}
@@ -165,6 +171,15 @@ func (g *Client) Commit(charts *packager.HelmizedManifests) error {
 		common.Log.Infof("Added crd-chart files from path: %s (current branch: %s)", crdsChartPath, headRef.Name().Short())
 	}
 
+	// Add all umbrella chart files
+	for _, umbrellaPath := range umbrellaPaths {
+		_, err = wt.Add(umbrellaPath)
+		if err != nil {
+			return fmt.Errorf("failed to add umbrella chart %s: %w", umbrellaPath, err)
+		}
+		common.Log.Infof("Added umbrella chart files from path: %s (current branch: %s)", umbrellaPath, headRef.Name().Short())
+	}
+
 	_, err = wt.Commit(
 		fmt.Sprintf("Automated update to version: %s", charts.AppVersion()),
 		&gogit.CommitOptions{
@@ -222,14 +237,14 @@ func (g *Client) Push(ctx context.Context, prSettings *common.PullRequest, branc
 	return nil
 }
 
-func (g *Client) unstage(wt *gogit.Worktree, chartPath, crdsChartPath string) error {
+func (g *Client) unstage(wt *gogit.Worktree, chartPaths ...string) error {
 	status, err := wt.Status()
 	if err != nil {
 		return fmt.Errorf("failed to get status: %w", err)
 	}
 	unstageFiles := make([]string, 0)
 	for filePath, status := range status {
-		if strings.HasPrefix(filePath, chartPath) || strings.HasPrefix(filePath, crdsChartPath) {
+		if slices.ContainsFunc(chartPaths, func(chartPath string) bool { return strings.HasPrefix(filePath, chartPath) }) {
 			_, err = wt.Add(filePath)
 			if err != nil {
 				return fmt.Errorf("failed to add file %s: %w", filePath, err)
@@ -0,0 +1,279 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	gogitplumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// GitSource implements common.ManifestSource backed by a directory of an upstream git repository.
+type GitSource struct {
+	cache   *common.Cache
+	cfg     *common.GitSourceConfig
+	release *common.ReleasePolicy
+	helm    *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeGit, common.SourceTraits{Versioned: true},
+		func(cfg *common.GitSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			return NewGitSource(env.Cache, cfg, release, helm), nil
+		})
+}
+
+// NewGitSource constructs a GitSource from the typed config blocks, the tags and checkouts go through the cache.
+func NewGitSource(cache *common.Cache, cfg *common.GitSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps) *GitSource {
+	return &GitSource{cache: cache, cfg: cfg, release: release, helm: helm}
+}
+
+func (s *GitSource) ChartName() string        { return s.helm.ChartName }
+func (s *GitSource) HelmOps() *common.HelmOps { return s.helm }
+
+// Fetch shallow-clones the repository at the tag selected by the release policy and reads manifests matching the configured paths.
+// Returns (nil, nil) when the chart is already at the selected tag.
+func (s *GitSource) Fetch(ctx context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	tag, err := SelectTag(ctx, s.cache, s.cfg.Url, s.cfg.TagPattern, s.release)
+	if err != nil {
+		return nil, err
+	}
+	common.Log.Infof("Selected tag for %s: %s", s.cfg.Url, tag)
+
+	if existingAppVersion == tag {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	remoteVersion, err := s.release.Normalize(tag)
+	if err != nil {
+		return nil, err
+	}
+	version, err := common.TakeNewerVersion(existingVersion, remoteVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", s.cfg.Url, err)
+	}
+
+	fs := memfs.New()
+	if err := CloneTag(ctx, s.cache, s.cfg.Url, tag, fs); err != nil {
+		return nil, err
+	}
+
+	assetsData := make(map[string][]byte)
+	for _, pattern := range s.cfg.Paths {
+		matches, err := util.Glob(fs, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("path pattern '%s' matched no files in %s@%s", pattern, s.cfg.Url, tag)
+		}
+		for _, match := range matches {
+			data, err := util.ReadFile(fs, match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s from %s@%s: %w", match, s.cfg.Url, tag, err)
+			}
+			assetsData[match] = data
+		}
+	}
+	common.Log.Infof("Read %d files from %s@%s", len(assetsData), s.cfg.Url, tag)
+
+	manifests, err := common.NewManifests(&assetsData, version, tag, &s.helm.AddValues, &s.helm.AddCrdValues)
+	if err != nil {
+		common.Log.Errorf("Failed to collect manifests for %s: %v", s.cfg.Url, err)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// ListReleases returns the repository tags matching the TagPattern
+func (s *GitSource) ListReleases(ctx context.Context) ([]string, error) {
+	return ListTags(ctx, s.cache, s.cfg.Url, s.cfg.TagPattern)
+}
+
+// SelectTag returns the remote tag chosen by the release policy, only tags matching the optional tagPattern are considered
+func SelectTag(ctx context.Context, cache *common.Cache, url, tagPattern string, release *common.ReleasePolicy) (string, error) {
+	tags, err := ListTags(ctx, cache, url, tagPattern)
+	if err != nil {
+		return "", err
+	}
+	tag, err := release.Select(tags)
+	if err != nil {
+		return "", fmt.Errorf("no tag of %s selected: %w", url, err)
+	}
+	return tag, nil
+}
+
+// ListTags returns the remote tags matching the optional tagPattern regex,
+// the listing is stored in the cache and read from it in offline mode
+func ListTags(ctx context.Context, cache *common.Cache, url, tagPattern string) ([]string, error) {
+	data, err := cache.Latest(func() ([]byte, error) {
+		tags, err := listRemoteTags(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(tags)
+	}, "git", url, "tags")
+	if err != nil {
+		return nil, err
+	}
+	var remoteTags []string
+	if err := json.Unmarshal(data, &remoteTags); err != nil {
+		return nil, fmt.Errorf("failed to decode tags of %s: %w", url, err)
+	}
+
+	tags := make([]string, 0, len(remoteTags))
+	for _, tag := range remoteTags {
+		if tagPattern != "" {
+			matches, err := common.Matches(tagPattern, tag)
+			if err != nil {
+				return nil, err
+			}
+			if !matches {
+				continue
+			}
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func listRemoteTags(ctx context.Context, url string) ([]string, error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: RemoteOrigin,
+		URLs: []string{url},
+	})
+	refs, err := remote.ListContext(ctx, &gogit.ListOptions{})
+	if err != nil {
+		common.Log.Errorf("Failed to list remote references of %s: %v", url, err)
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if !ref.Name().IsTag() || strings.HasSuffix(ref.Name().String(), "^{}") {
+			continue
+		}
+		tags = append(tags, ref.Name().Short())
+	}
+	return tags, nil
+}
+
+// CloneTag shallow-clones url at the given tag into the worktree fs,
+// the checkout of the tag is stored in the cache (as tar.gz) and reused instead of cloning again
+func CloneTag(ctx context.Context, cache *common.Cache, url, tag string, fs billy.Filesystem) error {
+	checkout, err := cache.Immutable(func() ([]byte, error) {
+		worktree := memfs.New()
+		if _, err := clone(ctx, url, tag, worktree); err != nil {
+			return nil, err
+		}
+		return pack(worktree)
+	}, "git", url, tag)
+	if err != nil {
+		return err
+	}
+	return unpack(checkout, fs)
+}
+
+// clone fetches just the tagged commit (depth 1) into the in-memory repository checked out to fs
+func clone(ctx context.Context, url, tag string, fs billy.Filesystem) (*gogit.Repository, error) {
+	repo, err := gogit.CloneContext(ctx, memory.NewStorage(), fs, &gogit.CloneOptions{
+		URL:           url,
+		ReferenceName: gogitplumbing.NewTagReferenceName(tag),
+		SingleBranch:  true,
+		Depth:         1,
+		Tags:          gogit.NoTags,
+	})
+	if err != nil {
+		common.Log.Errorf("Failed to clone %s at %s: %v", url, tag, err)
+		return nil, err
+	}
+	return repo, nil
+}
+
+// pack archives the files and symlinks of the worktree
+func pack(fs billy.Filesystem) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := util.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name = strings.TrimPrefix(name, "/")
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := fs.Readlink(name)
+			if err != nil {
+				return err
+			}
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target})
+		case info.Mode().IsRegular():
+			data, err := util.ReadFile(fs, name)
+			if err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(info.Mode().Perm()), Size: int64(len(data))}); err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive checkout: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unpack extracts the archive created by pack into the worktree fs
+func unpack(archive []byte, fs billy.Filesystem) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("invalid checkout archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid checkout archive: %w", err)
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			err = fs.Symlink(header.Linkname, header.Name)
+		case tar.TypeReg:
+			var data []byte
+			if data, err = io.ReadAll(tr); err == nil {
+				err = util.WriteFile(fs, header.Name, data, os.FileMode(header.Mode))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+}
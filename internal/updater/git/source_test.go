@@ -0,0 +1,273 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestSelectTag(t *testing.T) {
+	repoDir := newTestRepo(t,
+		testCommit{"v1.4.0", map[string]string{"README.md": "1.4.0"}},
+		testCommit{"v1.5.0", map[string]string{"README.md": "1.5.0"}},
+		testCommit{"chart-v9.0.0", map[string]string{"README.md": "chart"}},
+		testCommit{"v1.6.0-rc.0", map[string]string{"README.md": "1.6.0-rc.0"}},
+	)
+	tests := []struct {
+		name       string
+		tagPattern string
+		release    common.ReleasePolicy
+		want       string
+		wantErr    bool
+	}{
+		{"newest SemVer tag", "", common.ReleasePolicy{}, "v1.5.0", false},
+		{"tag pattern", `^v\d`, common.ReleasePolicy{}, "v1.5.0", false},
+		{"constraint", `^v\d`, common.ReleasePolicy{Constraint: "~1.4"}, "v1.4.0", false},
+		{"prereleases", `^v\d`, common.ReleasePolicy{Prereleases: true}, "v1.6.0-rc.0", false},
+		{"stripped prefix", "^chart-", common.ReleasePolicy{StripTag: "^chart-"}, "chart-v9.0.0", false},
+		{"no match", `^v\d`, common.ReleasePolicy{Constraint: ">=2"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			tag, err := SelectTag(context.Background(), nil, "file://"+repoDir, tt.tagPattern, &tt.release)
+
+			//then
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SelectTag() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tag != tt.want {
+				t.Errorf("SelectTag() = %s, want %s", tag, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t,
+		testCommit{"v1.1.0", map[string]string{
+			"deploy/operator.yaml": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: operator\n",
+			"deploy/crds.yaml":     "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: things.example.com\n",
+			"hack/kind.yaml":       "apiVersion: kind.x-k8s.io/v1alpha4\nkind: Cluster\n",
+		}},
+		testCommit{"v1.2.0", map[string]string{
+			"deploy/webhook.yaml": "apiVersion: v1\nkind: Service\nmetadata:\n  name: webhook\n",
+		}},
+		testCommit{"v1.3.0-rc.0", map[string]string{
+			"deploy/unreleased.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unreleased\n",
+		}},
+	)
+	source := NewGitSource(nil, &common.GitSourceConfig{
+		Url:   "file://" + repoDir,
+		Paths: []string{"deploy/*.yaml"},
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+		t.Errorf("Fetch() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	kinds := make([]string, 0, len(manifests.Manifests))
+	for _, manifest := range manifests.Manifests {
+		kinds = append(kinds, common.FieldValue(manifest, common.Kind))
+	}
+	slices.Sort(kinds)
+	if len(manifests.Crds) != 1 || strings.Join(kinds, ",") != "Deployment,Service" {
+		t.Errorf("Fetch() manifests = %v, crds = %d, want Deployment,Service of the tag's deploy dir and 1 crd", kinds, len(manifests.Crds))
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t, testCommit{"v1.2.0", map[string]string{"deploy/operator.yaml": "kind: Deployment\n"}})
+	source := NewGitSource(nil, &common.GitSourceConfig{
+		Url:   "file://" + repoDir,
+		Paths: []string{"deploy/*.yaml"},
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil || manifests != nil {
+		t.Errorf("Fetch() = %v, %v, want nil for an up to date chart", manifests, err)
+	}
+}
+
+func TestFetchNoMatchingPath(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t, testCommit{"v1.2.0", map[string]string{"deploy/operator.yaml": "kind: Deployment\n"}})
+	source := NewGitSource(nil, &common.GitSourceConfig{
+		Url:   "file://" + repoDir,
+		Paths: []string{"config/*.yaml"},
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	_, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), "matched no files") {
+		t.Errorf("Fetch() error = %v, want error for path pattern matching no files", err)
+	}
+}
+
+func TestCloneTag(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t,
+		testCommit{"v1.0.0", map[string]string{"deploy/operator.yaml": "v1.0.0"}},
+		testCommit{"v1.1.0", map[string]string{"deploy/operator.yaml": "v1.1.0", "deploy/new.yaml": "v1.1.0"}},
+	)
+	fs := memfs.New()
+
+	//when
+	err := CloneTag(context.Background(), nil, "file://"+repoDir, "v1.0.0", fs)
+
+	//then
+	if err != nil {
+		t.Fatalf("CloneTag() error = %v", err)
+	}
+	if data, err := util.ReadFile(fs, "deploy/operator.yaml"); err != nil || string(data) != "v1.0.0" {
+		t.Errorf("CloneTag() checkout = %q, %v, want the tag's content", data, err)
+	}
+	if _, err := fs.Stat("deploy/new.yaml"); !os.IsNotExist(err) {
+		t.Errorf("CloneTag() checked out a file of a later commit, error = %v", err)
+	}
+}
+
+func TestCloneShallow(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t,
+		testCommit{"v1.0.0", map[string]string{"deploy/operator.yaml": "v1.0.0"}},
+		testCommit{"v1.1.0", map[string]string{"deploy/operator.yaml": "v1.1.0"}},
+		testCommit{"v1.2.0", map[string]string{"deploy/operator.yaml": "v1.2.0"}},
+	)
+
+	//when
+	repo, err := clone(context.Background(), "file://"+repoDir, "v1.1.0", memfs.New())
+
+	//then
+	if err != nil {
+		t.Fatalf("clone() error = %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	commits, err := repo.Log(&gogit.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatalf("Log() error = %v", err)
+	}
+	count := 0
+	_ = commits.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Errorf("clone() fetched %d commits, want just the tagged one", count)
+	}
+}
+
+func TestCloneTagCached(t *testing.T) {
+	//given
+	repoDir := newTestRepo(t, testCommit{"v1.0.0", map[string]string{"deploy/operator.yaml": "kind: Deployment\n"}})
+	url := "file://" + repoDir
+	cacheDir := t.TempDir()
+	tags, err := ListTags(context.Background(), common.NewCache(cacheDir, false), url, "")
+	if err != nil {
+		t.Fatalf("ListTags() error = %v", err)
+	}
+	if err := CloneTag(context.Background(), common.NewCache(cacheDir, false), url, "v1.0.0", memfs.New()); err != nil {
+		t.Fatalf("CloneTag() error = %v", err)
+	}
+	if err := os.RemoveAll(repoDir); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	offline := common.NewCache(cacheDir, true)
+	offlineTags, tagsErr := ListTags(context.Background(), offline, url, "")
+	fs := memfs.New()
+	cloneErr := CloneTag(context.Background(), offline, url, "v1.0.0", fs)
+	missingErr := CloneTag(context.Background(), offline, url, "v2.0.0", memfs.New())
+
+	//then
+	if tagsErr != nil || len(offlineTags) != 1 || offlineTags[0] != tags[0] {
+		t.Errorf("ListTags() offline = %v, %v, want cached %v", offlineTags, tagsErr, tags)
+	}
+	if cloneErr != nil {
+		t.Fatalf("CloneTag() offline error = %v", cloneErr)
+	}
+	if data, err := util.ReadFile(fs, "deploy/operator.yaml"); err != nil || string(data) != "kind: Deployment\n" {
+		t.Errorf("CloneTag() offline checkout = %q, %v, want the cached file", data, err)
+	}
+	if !errors.Is(missingErr, common.ErrNotCached) {
+		t.Errorf("CloneTag() offline error = %v, want %v for a tag not cached", missingErr, common.ErrNotCached)
+	}
+}
+
+// testCommit adds (or overwrites) the files and tags the commit
+type testCommit struct {
+	tag   string
+	files map[string]string
+}
+
+// newTestRepo creates a local repository with the tagged commits, in order
+func newTestRepo(t *testing.T, commits ...testCommit) string {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("failed to init repository: %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, commit := range commits {
+		for name, content := range commit.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := wt.Commit("release "+commit.tag, &gogit.CommitOptions{
+			Author: &object.Signature{Name: "charter", Email: "charter@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		if _, err := repo.CreateTag(commit.tag, hash, nil); err != nil {
+			t.Fatalf("failed to tag: %v", err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,180 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v74/github"
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+const (
+	DefaultMaxRetries = 3
+	// DefaultMaxWait caps a single rate limit backoff, longer waits fail the request instead
+	DefaultMaxWait = 2 * time.Minute
+	// secondaryRateLimitWait is the backoff when GitHub doesn't tell how long to wait
+	secondaryRateLimitWait = time.Minute
+)
+
+// Client is the GitHub API client shared by the github sources and pull requests.
+// API responses go through the download cache, release assets are downloaded with the
+// uncached (but rate limit aware) downloads client and cached under their own keys.
+// The downloads client authenticates the asset requests only, not the redirects to the storage hosts.
+type Client struct {
+	*github.Client
+	downloads *http.Client
+	cache     *common.Cache
+	authToken string
+}
+
+// NewClient creates the client for github.com or the GitHub Enterprise instance of the settings,
+// httpClient is the underlying client (http.DefaultClient's transport when nil), e.g. for tests against httptest servers,
+// nil cache downloads everything directly.
+func NewClient(settings *common.GithubSettings, httpClient *http.Client, cache *common.Cache) (*Client, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	maxRetries := settings.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	limited := &rateLimitTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		maxWait:    DefaultMaxWait,
+		sleep:      sleep,
+	}
+
+	api := github.NewClient(&http.Client{Transport: cache.Transport(limited), Timeout: httpClient.Timeout})
+	downloads := &http.Client{Transport: limited, Timeout: httpClient.Timeout, CheckRedirect: dropCrossHostAuth}
+	if settings.AuthToken != "" {
+		api = api.WithAuthToken(settings.AuthToken)
+	}
+	if settings.ApiUrl != "" {
+		uploadUrl := settings.UploadUrl
+		if uploadUrl == "" {
+			uploadUrl = settings.ApiUrl
+		}
+		var err error
+		api, err = api.WithEnterpriseURLs(settings.ApiUrl, uploadUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GitHub Enterprise URLs: %w", err)
+		}
+	}
+	return &Client{Client: api, downloads: downloads, cache: cache, authToken: settings.AuthToken}, nil
+}
+
+// dropCrossHostAuth removes the Authorization header from redirects leaving the host of the original request,
+// release assets redirect to storage hosts (e.g. S3 presigned URLs) which must not receive the token.
+// Unlike net/http, which keeps the header for any port of the same host name, the port is compared too
+func dropCrossHostAuth(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// sharedClient returns the client of the env, the anonymous github.com client when none is set up
+func sharedClient(env *common.SourceEnv) *Client {
+	if client, ok := env.Clients[common.SourceTypeGithub].(*Client); ok {
+		return client
+	}
+	client, _ := NewClient(&common.GithubSettings{}, nil, env.Cache) // fails for invalid Enterprise URLs only
+	return client
+}
+
+// rateLimitTransport retries requests rejected by GitHub's primary or secondary rate limits,
+// waiting as instructed by Retry-After or X-RateLimit-Reset headers, unless the wait outlasts the request's deadline
+type rateLimitTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	maxWait    time.Duration
+	sleep      func(ctx context.Context, d time.Duration) error
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := rateLimitWait(resp, time.Now())
+		if !limited || attempt >= t.maxRetries {
+			return resp, nil
+		}
+		if wait > t.maxWait {
+			common.Log.Warnf("GitHub rate limit of %s resets in %s, not waiting", req.URL.Path, wait)
+			return resp, nil
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("GitHub rate limit of %s resets in %s, after the deadline of the request (see timeout setting)", req.URL.Path, wait)
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil // body can't be replayed
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		common.Log.Warnf("GitHub rate limit hit for %s, retrying in %s (attempt %d/%d)", req.URL.Path, wait, attempt+1, t.maxRetries)
+		if err := t.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// rateLimitWait tells whether the response was rejected due to a rate limit and how long to wait before retrying
+func rateLimitWait(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return max(at.Sub(now), 0), true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Unix(reset, 0).Sub(now), 0) + time.Second, true
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return secondaryRateLimitWait, true
+	}
+	return 0, false // plain 403, e.g. missing permissions
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
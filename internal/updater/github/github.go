@@ -3,33 +3,59 @@ package github
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
 
-	"github.com/Masterminds/semver/v3"
 	"github.com/google/go-github/v74/github"
 	"github.com/kiemlicz/charter/internal/common"
 )
 
 // GithubSource implements common.ManifestSource backed by a GitHub release.
 type GithubSource struct {
-	cfg  *common.GithubSourceConfig
-	helm *common.HelmOps
+	client  *Client
+	cfg     *common.GithubSourceConfig
+	release *common.ReleasePolicy
+	helm    *common.HelmOps
 }
 
-// NewGithubSource constructs a GithubSource from the typed config blocks.
-func NewGithubSource(cfg *common.GithubSourceConfig, helm *common.HelmOps) *GithubSource {
-	return &GithubSource{cfg: cfg, helm: helm}
+func init() {
+	common.RegisterSource(common.SourceTypeGithub, common.SourceTraits{Versioned: true},
+		func(cfg *common.GithubSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			if err := cfg.Verify.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid verify block: %w", err)
+			}
+			return NewGithubSource(sharedClient(env), cfg, release, helm), nil
+		})
+}
+
+// NewGithubSource constructs a GithubSource from the typed config blocks, using the shared client.
+func NewGithubSource(client *Client, cfg *common.GithubSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps) *GithubSource {
+	return &GithubSource{client: client, cfg: cfg, release: release, helm: helm}
 }
 
 func (s *GithubSource) ChartName() string        { return s.helm.ChartName }
 func (s *GithubSource) HelmOps() *common.HelmOps { return s.helm }
 func (s *GithubSource) Fetch(ctx context.Context, currentVersion, currentAppVersion string) (*common.Manifests, error) {
-	return FetchManifests(ctx, s.cfg, s.helm, currentVersion, currentAppVersion)
+	return FetchManifests(ctx, s.client, s.cfg, s.release, s.helm, currentVersion, currentAppVersion)
+}
+
+// ListReleases returns the tags of all published (non-draft) releases
+func (s *GithubSource) ListReleases(ctx context.Context) ([]string, error) {
+	releases, err := listReleases(ctx, s.client, s.cfg.Owner, s.cfg.Repo)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(releases))
+	for _, r := range releases {
+		if r.GetDraft() {
+			continue
+		}
+		tags = append(tags, r.GetTagName())
+	}
+	return tags, nil
 }
 
 // CreatePr creates a Pull Request into default branch
-func CreatePr(ctx context.Context, prSettings *common.PullRequest, srcBranch string) error {
+func CreatePr(ctx context.Context, client *Client, prSettings *common.PullRequest, srcBranch string) error {
 	defaultBranch := prSettings.DefaultBranch
 
 	if defaultBranch == "" {
@@ -42,8 +68,6 @@ func CreatePr(ctx context.Context, prSettings *common.PullRequest, srcBranch str
 		return fmt.Errorf("source branch equals default branch")
 	}
 
-	client := github.NewClient(nil).WithAuthToken(prSettings.AuthToken)
-
 	newPR := &github.NewPullRequest{
 		Title: github.Ptr(fmt.Sprintf(prSettings.Title, srcBranch)),
 		Head:  github.Ptr(srcBranch),
@@ -64,24 +88,27 @@ func CreatePr(ctx context.Context, prSettings *common.PullRequest, srcBranch str
 	return nil
 }
 
-// FetchManifests downloads the latest GitHub release assets and parses them into Manifests.
-// Returns (nil, nil) when the chart is already at the latest version.
-func FetchManifests(ctx context.Context, cfg *common.GithubSourceConfig, helmOps *common.HelmOps, existingVersion, existingAppVersion string) (*common.Manifests, error) {
-	client := github.NewClient(nil)
-	releaseData, err := downloadReleaseMeta(ctx, client, cfg.Owner, cfg.Repo)
+// FetchManifests downloads the GitHub release assets selected by the release policy and parses them into Manifests.
+// Returns (nil, nil) when the chart is already at the selected version.
+func FetchManifests(ctx context.Context, client *Client, cfg *common.GithubSourceConfig, release *common.ReleasePolicy, helmOps *common.HelmOps, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	releaseData, err := downloadReleaseMeta(ctx, client, cfg.Owner, cfg.Repo, release)
 	if err != nil {
 		common.Log.Errorf("Failed to download release metadata for %s: %v", cfg.Repo, err)
 		return nil, err
 	}
 	releaseVersion := releaseData.TagName
-	common.Log.Infof("Latest release for %s: %s", cfg.Repo, *releaseVersion)
+	common.Log.Infof("Selected release for %s: %s", cfg.Repo, *releaseVersion)
 
 	if existingAppVersion == *releaseVersion {
 		common.Log.Infof("Helm chart %s is already up to date with version %s", helmOps.ChartName, existingAppVersion)
 		return nil, nil
 	}
 
-	version, err := takeNewerVersion(existingVersion, *releaseVersion)
+	remoteVersion, err := release.Normalize(*releaseVersion)
+	if err != nil {
+		return nil, err
+	}
+	version, err := common.TakeNewerVersion(existingVersion, remoteVersion)
 	if err != nil {
 		return nil, fmt.Errorf("version resolution failed for %s: %w", cfg.Repo, err)
 	}
@@ -99,25 +126,57 @@ func FetchManifests(ctx context.Context, cfg *common.GithubSourceConfig, helmOps
 	return manifests, nil
 }
 
-func takeNewerVersion(existingVersion, remoteVersion string) (*semver.Version, error) {
-	semverExisting, _ := semver.NewVersion(existingVersion)
-	semverRemote, err := semver.NewVersion(remoteVersion)
+func downloadReleaseMeta(ctx context.Context, client *Client, owner, repo string, release *common.ReleasePolicy) (*github.RepositoryRelease, error) {
+	if release.FollowsLatest() {
+		repoRelease, response, err := client.Repositories.GetLatestRelease(ctx, owner, repo)
+		return checkRelease(repoRelease, response, err)
+	}
+	if release.Pin != "" {
+		repoRelease, response, err := client.Repositories.GetReleaseByTag(ctx, owner, repo, release.Pin)
+		return checkRelease(repoRelease, response, err)
+	}
+
+	releases, err := listReleases(ctx, client, owner, repo)
 	if err != nil {
-		if semverExisting == nil {
-			return nil, fmt.Errorf("neither existing version %q nor remote version %q are valid SemVer", existingVersion, remoteVersion)
+		return nil, err
+	}
+	byTag := make(map[string]*github.RepositoryRelease, len(releases))
+	tags := make([]string, 0, len(releases))
+	for _, r := range releases {
+		if r.GetDraft() || (r.GetPrerelease() && !release.Prereleases) {
+			continue
 		}
-		common.Log.Warnf("Remote version %s is not valid SemVer: %v, will use existing Chart's version: %s", remoteVersion, err, existingVersion)
-		return semverExisting, nil
+		byTag[r.GetTagName()] = r
+		tags = append(tags, r.GetTagName())
+	}
+	tag, err := release.Select(tags)
+	if err != nil {
+		return nil, fmt.Errorf("no release of %s/%s selected: %w", owner, repo, err)
 	}
+	return byTag[tag], nil
+}
 
-	if semverRemote.Compare(semverExisting) < 0 {
-		return semverExisting, nil
+func listReleases(ctx context.Context, client *Client, owner, repo string) ([]*github.RepositoryRelease, error) {
+	releases := make([]*github.RepositoryRelease, 0)
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, response, err := client.Repositories.ListReleases(ctx, owner, repo, opts)
+		if err != nil {
+			if response != nil {
+				err = fmt.Errorf("failed to list releases: %v, status: %d", err, response.StatusCode)
+			}
+			return nil, err
+		}
+		releases = append(releases, page...)
+		if response.NextPage == 0 {
+			break
+		}
+		opts.Page = response.NextPage
 	}
-	return semverRemote, nil
+	return releases, nil
 }
 
-func downloadReleaseMeta(ctx context.Context, client *github.Client, owner, repo string) (*github.RepositoryRelease, error) {
-	repoRelease, response, err := client.Repositories.GetLatestRelease(ctx, owner, repo)
+func checkRelease(repoRelease *github.RepositoryRelease, response *github.Response, err error) (*github.RepositoryRelease, error) {
 	if err != nil || response.StatusCode != http.StatusOK {
 		if response != nil {
 			err = fmt.Errorf("failed to download release: %v, status: %d", err, response.StatusCode)
@@ -128,41 +187,95 @@ func downloadReleaseMeta(ctx context.Context, client *github.Client, owner, repo
 	return repoRelease, nil
 }
 
-func downloadReleaseAsset(ctx context.Context, client *github.Client, owner string, repo string, asset *github.ReleaseAsset) ([]byte, error) {
-	reader, _, err := client.Repositories.DownloadReleaseAsset(ctx, owner, repo, asset.GetID(), client.Client())
+// downloadReleaseAsset downloads the asset through the client's cache, keyed by the repository, release tag and asset name
+func downloadReleaseAsset(ctx context.Context, client *Client, owner string, repo string, tag string, asset *github.ReleaseAsset) ([]byte, error) {
+	req, err := client.NewRequest(http.MethodGet, asset.GetURL(), nil)
 	if err != nil {
-		common.Log.Errorf("Failed to download release asset: %v", err)
 		return nil, err
 	}
-	defer reader.Close()
+	req.Header.Set("Accept", "application/octet-stream")
+	if client.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+client.authToken) // on the request, so redirects to other hosts drop it
+	}
 
-	assetData, err := io.ReadAll(reader)
+	// assets are served by redirects to short-lived URLs, these mustn't go through the caching transport
+	assetData, err := client.cache.Fetch(client.downloads, req.WithContext(ctx), "github", owner, repo, tag, asset.GetName())
 	if err != nil {
-		common.Log.Errorf("Failed to read release asset data: %v", err)
+		common.Log.Errorf("Failed to download release asset: %v", err)
 		return nil, err
 	}
-
 	return assetData, nil
 }
 
-func downloadAssets(ctx context.Context, client *github.Client, cfg *common.GithubSourceConfig, releaseData *github.RepositoryRelease) (*map[string][]byte, error) {
-	assetsData := make(map[string][]byte)
-	for _, asset := range cfg.Assets {
-		assetsData[asset] = []byte{}
+func downloadAssets(ctx context.Context, client *Client, cfg *common.GithubSourceConfig, releaseData *github.RepositoryRelease) (*map[string][]byte, error) {
+	selectedAssets, err := selectAssets(cfg.Assets, releaseData)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, asset := range releaseData.Assets {
-		if _, ok := assetsData[asset.GetName()]; ok {
-			data, err := downloadReleaseAsset(ctx, client, cfg.Owner, cfg.Repo, asset)
-			if err != nil {
-				common.Log.Errorf("Failed to download asset %s for release %s: %v", asset.GetName(), cfg.Repo, err)
-				return nil, err
+	downloaded := make(map[string][]byte, len(selectedAssets))
+	for _, asset := range selectedAssets {
+		data, err := downloadReleaseAsset(ctx, client, cfg.Owner, cfg.Repo, releaseData.GetTagName(), asset)
+		if err != nil {
+			common.Log.Errorf("Failed to download asset %s for release %s: %v", asset.GetName(), cfg.Repo, err)
+			return nil, err
+		}
+		common.Log.Infof("Downloaded asset %s for release %s, size: %d bytes", asset.GetName(), cfg.Repo, len(data))
+		downloaded[asset.GetName()] = data
+	}
+
+	err = cfg.Verify.VerifyAssets(downloaded, func(name string) ([]byte, error) {
+		for _, asset := range releaseData.Assets {
+			if asset.GetName() == name {
+				return downloadReleaseAsset(ctx, client, cfg.Owner, cfg.Repo, releaseData.GetTagName(), asset)
 			}
-			common.Log.Infof("Downloaded asset %s for release %s, size: %d bytes", asset.GetName(), cfg.Repo, len(data))
+		}
+		return nil, fmt.Errorf("asset %s not found in release %s", name, releaseData.GetTagName())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verification of release %s of %s failed: %w", releaseData.GetTagName(), cfg.Repo, err)
+	}
 
-			assetsData[asset.GetName()] = data
+	assetsData := make(map[string][]byte)
+	for _, asset := range selectedAssets {
+		files, err := common.ExtractArchive(asset.GetName(), downloaded[asset.GetName()], cfg.ArchivePaths)
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range files {
+			if _, duplicate := assetsData[name]; duplicate {
+				return nil, fmt.Errorf("asset %s of release %s of %s extracts to %s, the same name as another asset", asset.GetName(), releaseData.GetTagName(), cfg.Repo, name)
+			}
+			assetsData[name] = content
 		}
 	}
 	common.Log.Infof("Total assets downloaded for release %s: %d", cfg.Repo, len(assetsData))
 	return &assetsData, nil
 }
+
+// selectAssets returns release assets matching the patterns, every pattern must match at least one asset
+func selectAssets(patterns []string, releaseData *github.RepositoryRelease) ([]*github.ReleaseAsset, error) {
+	selected := make([]*github.ReleaseAsset, 0, len(patterns))
+	seen := make(map[int64]bool)
+	for _, pattern := range patterns {
+		found := false
+		for _, asset := range releaseData.Assets {
+			matches, err := common.MatchesAsset(pattern, asset.GetName())
+			if err != nil {
+				return nil, err
+			}
+			if !matches {
+				continue
+			}
+			found = true
+			if !seen[asset.GetID()] {
+				seen[asset.GetID()] = true
+				selected = append(selected, asset)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("required asset %q not found in release %s", pattern, releaseData.GetTagName())
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,394 @@
+package github
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v74/github"
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+const (
+	testOwner    = "acme"
+	testRepo     = "operator"
+	testToken    = "test-token"
+	testOperator = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+`
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestFetchManifests(t *testing.T) {
+	//given
+	server, _ := newTestGithub(t, "v1.2.0", 0)
+	client := newTestClient(t, server)
+	cfg := common.GithubSourceConfig{Owner: testOwner, Repo: testRepo, Assets: []string{"operator.yaml"}}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	manifests, err := FetchManifests(context.Background(), client, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	if manifests == nil {
+		t.Fatalf("FetchManifests() returned no manifests for a newer release")
+	}
+	if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+		t.Errorf("FetchManifests() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	if len(manifests.Manifests) != 1 {
+		t.Errorf("FetchManifests() manifests = %d, want 1", len(manifests.Manifests))
+	}
+}
+
+func TestFetchManifestsSameExtractedName(t *testing.T) {
+	//given
+	server, _ := newTestGithub(t, "v1.2.0", 0)
+	client := newTestClient(t, server)
+	cfg := common.GithubSourceConfig{Owner: testOwner, Repo: testRepo, Assets: []string{"operator.yaml", "operator.yaml.gz"}}
+
+	//when
+	_, err := FetchManifests(context.Background(), client, &cfg, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"}, "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), "asset operator.yaml.gz of release v1.2.0 of operator extracts to operator.yaml") {
+		t.Errorf("FetchManifests() error = %v, want error for assets overwriting each other", err)
+	}
+}
+
+func TestNewSourceSharedClient(t *testing.T) {
+	//given
+	server, _ := newTestGithub(t, "v1.2.0", 0)
+	client := newTestClient(t, server)
+	spec := common.SourceSpec{
+		Type:   common.SourceTypeGithub,
+		Blocks: map[string]any{string(common.SourceTypeGithub): map[string]any{"owner": testOwner, "repo": testRepo}},
+	}
+	env := common.SourceEnv{Clients: map[common.SourceType]any{common.SourceTypeGithub: client}}
+
+	//when
+	shared, err := common.NewSource(0, &spec, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"}, &env)
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+	anonymous, err := common.NewSource(0, &spec, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"}, nil)
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+
+	//then
+	if shared.(*GithubSource).client != client {
+		t.Errorf("NewSource() didn't use the client of the env")
+	}
+	if c := anonymous.(*GithubSource).client; c == nil || c == client || c.authToken != "" {
+		t.Errorf("NewSource() without env client = %v, want the anonymous client", c)
+	}
+}
+
+func TestSelectAssets(t *testing.T) {
+	releaseData := &github.RepositoryRelease{
+		TagName: github.Ptr("v1.2.0"),
+		Assets: []*github.ReleaseAsset{
+			{ID: github.Ptr(int64(1)), Name: github.Ptr("cdi-operator.yaml")},
+			{ID: github.Ptr(int64(2)), Name: github.Ptr("cdi-cr.yaml")},
+			{ID: github.Ptr(int64(3)), Name: github.Ptr("cdi-manifests.tar.gz")},
+		},
+	}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		wantErr  string
+	}{
+		{"exact names", []string{"cdi-operator.yaml", "cdi-cr.yaml"}, []string{"cdi-operator.yaml", "cdi-cr.yaml"}, ""},
+		{"glob", []string{"*.yaml"}, []string{"cdi-operator.yaml", "cdi-cr.yaml"}, ""},
+		{"regex", []string{`/^cdi-(operator\.yaml|.*\.tar\.gz)$/`}, []string{"cdi-operator.yaml", "cdi-manifests.tar.gz"}, ""},
+		{"overlapping patterns", []string{"cdi-*", "*.yaml"}, []string{"cdi-operator.yaml", "cdi-cr.yaml", "cdi-manifests.tar.gz"}, ""},
+		{"missing asset", []string{"cdi-operator.yaml", "cdi-crds.yaml"}, nil, `required asset "cdi-crds.yaml" not found in release v1.2.0`},
+		{"regex matching nothing", []string{"/^kubevirt-/"}, nil, "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//when
+			selected, err := selectAssets(tt.patterns, releaseData)
+
+			//then
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("selectAssets() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			names := make([]string, 0, len(selected))
+			for _, asset := range selected {
+				names = append(names, asset.GetName())
+			}
+			if err != nil || fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("selectAssets() = %v, %v, want %v", names, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadReleaseAssetRedirectWithoutToken(t *testing.T) {
+	//given
+	var authorization atomic.Value
+	authorization.Store("")
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		_, _ = fmt.Fprint(w, testOperator)
+	}))
+	t.Cleanup(storage.Close)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, storage.URL+"/operator.yaml", http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server)
+	asset := &github.ReleaseAsset{ID: github.Ptr(int64(1)), Name: github.Ptr("operator.yaml"), URL: github.Ptr(server.URL + "/api/v3/repos/acme/operator/releases/assets/1")}
+
+	//when
+	data, err := downloadReleaseAsset(context.Background(), client, testOwner, testRepo, "v1.2.0", asset)
+
+	//then
+	if err != nil {
+		t.Fatalf("downloadReleaseAsset() error = %v", err)
+	}
+	if string(data) != testOperator {
+		t.Errorf("downloadReleaseAsset() = %q, want the asset served by the storage host", data)
+	}
+	if got := authorization.Load(); got != "" {
+		t.Errorf("storage host received Authorization %q, want none", got)
+	}
+}
+
+func TestFetchManifestsRateLimited(t *testing.T) {
+	//given
+	server, requests := newTestGithub(t, "v1.2.0", 2)
+	client := newTestClient(t, server)
+	cfg := common.GithubSourceConfig{Owner: testOwner, Repo: testRepo, Assets: []string{"operator.yaml"}}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	manifests, err := FetchManifests(context.Background(), client, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	if manifests == nil || manifests.AppVersion != "v1.2.0" {
+		t.Fatalf("FetchManifests() = %v, want manifests of v1.2.0", manifests)
+	}
+	// 2 rejected and 1 successful release metadata request, asset and its redirect
+	if got := requests.Load(); got != 5 {
+		t.Errorf("FetchManifests() sent %d requests, want 5", got)
+	}
+}
+
+func TestFetchManifestsRateLimitExhausted(t *testing.T) {
+	//given
+	server, _ := newTestGithub(t, "v1.2.0", DefaultMaxRetries+1)
+	client := newTestClient(t, server)
+	cfg := common.GithubSourceConfig{Owner: testOwner, Repo: testRepo, Assets: []string{"operator.yaml"}}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	_, err := FetchManifests(context.Background(), client, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil {
+		t.Errorf("FetchManifests() expected error when rate limit retries are exhausted")
+	}
+}
+
+func TestFetchManifestsRateLimitPastDeadline(t *testing.T) {
+	//given
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, `{"message": "You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server)
+	cfg := common.GithubSourceConfig{Owner: testOwner, Repo: testRepo, Assets: []string{"operator.yaml"}}
+	helmOps := common.HelmOps{ChartName: "operator"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	//when
+	start := time.Now()
+	_, err := FetchManifests(ctx, client, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil || !strings.Contains(err.Error(), "after the deadline") {
+		t.Errorf("FetchManifests() error = %v, want the rate limit reset after the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FetchManifests() failed after %s, want without waiting", elapsed)
+	}
+}
+
+func TestCreatePrRetriesBody(t *testing.T) {
+	//given
+	var attempts atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v3/repos/acme/charts/pulls", func(w http.ResponseWriter, r *http.Request) {
+		var pr map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&pr); err != nil || pr["head"] != "update/operator-1.2.0" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "secondary rate limit", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprint(w, `{"number": 7, "html_url": "https://ghe.example.com/acme/charts/pull/7"}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server)
+	prSettings := common.PullRequest{DefaultBranch: "main", Title: "Update %s", Owner: "acme", Repo: "charts"}
+
+	//when
+	err := CreatePr(context.Background(), client, &prSettings, "update/operator-1.2.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("CreatePr() error = %v", err)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("CreatePr() sent %d requests, want 2", got)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name        string
+		status      int
+		header      map[string]string
+		wantWait    time.Duration
+		wantLimited bool
+	}{
+		{"ok", http.StatusOK, nil, 0, false},
+		{"forbidden", http.StatusForbidden, nil, 0, false},
+		{"retry after seconds", http.StatusForbidden, map[string]string{"Retry-After": "30"}, 30 * time.Second, true},
+		{"retry after date", http.StatusTooManyRequests, map[string]string{"Retry-After": now.Add(10 * time.Second).UTC().Format(http.TimeFormat)}, 10 * time.Second, true},
+		{"primary limit", http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(now.Unix()+60, 10)}, 61 * time.Second, true},
+		{"secondary limit without hint", http.StatusTooManyRequests, nil, secondaryRateLimitWait, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, v := range tt.header {
+				resp.Header.Set(k, v)
+			}
+			wait, limited := rateLimitWait(resp, now)
+			if wait != tt.wantWait || limited != tt.wantLimited {
+				t.Errorf("rateLimitWait() = %s, %t, want %s, %t", wait, limited, tt.wantWait, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	settings := common.GithubSettings{ApiUrl: server.URL + "/api/v3/", AuthToken: testToken}
+	client, err := NewClient(&settings, server.Client(), nil)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return client
+}
+
+// newTestGithub serves a GitHub Enterprise API with the latest release tag having operator.yaml and its gzipped operator.yaml.gz assets,
+// the first rateLimited release metadata requests are rejected by the secondary rate limit.
+// The asset redirects to a storage server which, like S3 presigned URLs, rejects requests carrying the Authorization header
+func newTestGithub(t *testing.T, tag string, rateLimited int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	storage := newTestStorage(t, &requests)
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("GET /api/v3/repos/acme/operator/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited > 0 {
+			rateLimited--
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"message": "You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+			return
+		}
+		release := map[string]any{
+			"tag_name": tag,
+			"assets": []map[string]any{
+				{"id": 1, "name": "operator.yaml", "url": server.URL + "/api/v3/repos/acme/operator/releases/assets/1"},
+				{"id": 2, "name": "operator.yaml.gz", "url": server.URL + "/api/v3/repos/acme/operator/releases/assets/2"},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(release)
+	})
+	mux.HandleFunc("GET /api/v3/repos/acme/operator/releases/assets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/octet-stream" {
+			http.Error(w, "asset metadata not served", http.StatusNotAcceptable)
+			return
+		}
+		name := map[string]string{"1": "operator.yaml", "2": "operator.yaml.gz"}[r.PathValue("id")]
+		http.Redirect(w, r, storage.URL+"/"+name, http.StatusFound)
+	})
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestStorage(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "Only one auth mechanism allowed", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/operator.yaml":
+			_, _ = fmt.Fprint(w, testOperator)
+		case "/operator.yaml.gz":
+			gz := gzip.NewWriter(w)
+			_, _ = fmt.Fprint(gz, testOperator)
+			_ = gz.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(storage.Close)
+	return storage
+}
@@ -0,0 +1,304 @@
+// Package gitlab provides a ManifestSource backed by GitLab releases (gitlab.com or self-hosted).
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+const (
+	DefaultBaseUrl = "https://gitlab.com"
+	TokenEnv       = "GITLAB_TOKEN"
+)
+
+// downloadClient downloads the release assets, the redirects to other hosts (e.g. object storage) go without the token
+var downloadClient = &http.Client{CheckRedirect: dropCrossHostToken}
+
+// release is the subset of the GitLab Releases API response used here
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  struct {
+		Links []assetLink `json:"links"`
+	} `json:"assets"`
+}
+
+type assetLink struct {
+	Name           string `json:"name"`
+	Url            string `json:"url"`
+	DirectAssetUrl string `json:"direct_asset_url"`
+}
+
+func (l *assetLink) downloadUrl() string {
+	if l.DirectAssetUrl != "" {
+		return l.DirectAssetUrl
+	}
+	return l.Url
+}
+
+// GitlabSource implements common.ManifestSource backed by a GitLab release.
+type GitlabSource struct {
+	cache   *common.Cache
+	cfg     *common.GitlabSourceConfig
+	release *common.ReleasePolicy
+	helm    *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeGitlab, common.SourceTraits{Versioned: true},
+		func(cfg *common.GitlabSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			if err := cfg.Verify.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid verify block: %w", err)
+			}
+			return NewGitlabSource(env.Cache, cfg, release, helm), nil
+		})
+}
+
+// NewGitlabSource constructs a GitlabSource from the typed config blocks, downloading through the cache.
+func NewGitlabSource(cache *common.Cache, cfg *common.GitlabSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps) *GitlabSource {
+	return &GitlabSource{cache: cache, cfg: cfg, release: release, helm: helm}
+}
+
+func (s *GitlabSource) ChartName() string        { return s.helm.ChartName }
+func (s *GitlabSource) HelmOps() *common.HelmOps { return s.helm }
+func (s *GitlabSource) Fetch(ctx context.Context, currentVersion, currentAppVersion string) (*common.Manifests, error) {
+	return FetchManifests(ctx, s.cache, s.cfg, s.release, s.helm, currentVersion, currentAppVersion)
+}
+
+// ListReleases returns the tags of all releases of the project
+func (s *GitlabSource) ListReleases(ctx context.Context) ([]string, error) {
+	releases, err := newClient(s.cache, s.cfg).listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(releases))
+	for _, r := range releases {
+		tags = append(tags, r.TagName)
+	}
+	return tags, nil
+}
+
+// FetchManifests downloads the GitLab release assets selected by the release policy and parses them into Manifests.
+// Returns (nil, nil) when the chart is already at the selected version.
+func FetchManifests(ctx context.Context, cache *common.Cache, cfg *common.GitlabSourceConfig, release *common.ReleasePolicy, helmOps *common.HelmOps, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	client := newClient(cache, cfg)
+	releaseData, err := client.selectRelease(ctx, release)
+	if err != nil {
+		common.Log.Errorf("Failed to download release metadata for %s: %v", cfg.Project, err)
+		return nil, err
+	}
+	releaseVersion := releaseData.TagName
+	common.Log.Infof("Selected release for %s: %s", cfg.Project, releaseVersion)
+
+	if existingAppVersion == releaseVersion {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", helmOps.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	remoteVersion, err := release.Normalize(releaseVersion)
+	if err != nil {
+		return nil, err
+	}
+	version, err := common.TakeNewerVersion(existingVersion, remoteVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", cfg.Project, err)
+	}
+
+	assetsData, err := client.downloadAssets(ctx, cfg.Assets, cfg.Verify, releaseData)
+	if err != nil {
+		common.Log.Errorf("Failed to download assets for release %s: %v", cfg.Project, err)
+		return nil, err
+	}
+	manifests, err := common.NewManifests(assetsData, version, releaseVersion, &helmOps.AddValues, &helmOps.AddCrdValues)
+	if err != nil {
+		common.Log.Errorf("Failed to collect manifests for release %s: %v", cfg.Project, err)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+type client struct {
+	cache   *common.Cache
+	baseUrl string
+	project string
+	token   string
+}
+
+func newClient(cache *common.Cache, cfg *common.GitlabSourceConfig) *client {
+	baseUrl := cfg.BaseUrl
+	if baseUrl == "" {
+		baseUrl = DefaultBaseUrl
+	}
+	token := cfg.AuthToken
+	if token == "" {
+		token = os.Getenv(TokenEnv)
+	}
+	return &client{
+		cache:   cache,
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		project: cfg.Project,
+		token:   token,
+	}
+}
+
+func (c *client) selectRelease(ctx context.Context, policy *common.ReleasePolicy) (*release, error) {
+	if policy.FollowsLatest() {
+		return c.release(ctx, "permalink/latest")
+	}
+	if policy.Pin != "" {
+		return c.release(ctx, url.PathEscape(policy.Pin))
+	}
+
+	releases, err := c.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byTag := make(map[string]*release, len(releases))
+	tags := make([]string, 0, len(releases))
+	for i := range releases {
+		byTag[releases[i].TagName] = &releases[i]
+		tags = append(tags, releases[i].TagName)
+	}
+	tag, err := policy.Select(tags)
+	if err != nil {
+		return nil, fmt.Errorf("no release of %s selected: %w", c.project, err)
+	}
+	return byTag[tag], nil
+}
+
+func (c *client) release(ctx context.Context, name string) (*release, error) {
+	data, _, err := c.get(ctx, fmt.Sprintf("%s/releases/%s", c.projectUrl(), name))
+	if err != nil {
+		return nil, err
+	}
+	var r release
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to decode release of %s: %w", c.project, err)
+	}
+	if r.TagName == "" {
+		return nil, fmt.Errorf("release of %s has no tag", c.project)
+	}
+	return &r, nil
+}
+
+func (c *client) listReleases(ctx context.Context) ([]release, error) {
+	releases := make([]release, 0)
+	page := "1"
+	for page != "" {
+		data, header, err := c.get(ctx, fmt.Sprintf("%s/releases?per_page=100&page=%s", c.projectUrl(), page))
+		if err != nil {
+			return nil, err
+		}
+		var pageReleases []release
+		if err := json.Unmarshal(data, &pageReleases); err != nil {
+			return nil, fmt.Errorf("failed to decode releases of %s: %w", c.project, err)
+		}
+		releases = append(releases, pageReleases...)
+		page = header.Get("X-Next-Page")
+	}
+	return releases, nil
+}
+
+func (c *client) projectUrl() string {
+	return fmt.Sprintf("%s/api/v4/projects/%s", c.baseUrl, url.PathEscape(c.project))
+}
+
+func (c *client) downloadAssets(ctx context.Context, assets []string, verify *common.VerifyConfig, releaseData *release) (*map[string][]byte, error) {
+	links := make(map[string]assetLink, len(releaseData.Assets.Links))
+	for _, link := range releaseData.Assets.Links {
+		links[link.Name] = link
+	}
+
+	assetsData := make(map[string][]byte)
+	for _, asset := range assets {
+		link, ok := links[asset]
+		if !ok {
+			return nil, fmt.Errorf("asset %s not found in release %s of %s", asset, releaseData.TagName, c.project)
+		}
+		data, err := c.download(ctx, link.downloadUrl(), releaseData.TagName, asset)
+		if err != nil {
+			common.Log.Errorf("Failed to download asset %s for release %s: %v", asset, c.project, err)
+			return nil, err
+		}
+		common.Log.Infof("Downloaded asset %s for release %s, size: %d bytes", asset, c.project, len(data))
+		assetsData[asset] = data
+	}
+
+	err := verify.VerifyAssets(assetsData, func(name string) ([]byte, error) {
+		link, ok := links[name]
+		if !ok {
+			return nil, fmt.Errorf("asset %s not found in release %s", name, releaseData.TagName)
+		}
+		return c.download(ctx, link.downloadUrl(), releaseData.TagName, name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verification of release %s of %s failed: %w", releaseData.TagName, c.project, err)
+	}
+	common.Log.Infof("Total assets downloaded for release %s: %d", c.project, len(assetsData))
+	return &assetsData, nil
+}
+
+// download fetches the release asset through the cache, keyed by the project, release tag and asset name
+func (c *client) download(ctx context.Context, target, tag, asset string) ([]byte, error) {
+	req, err := c.newRequest(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return c.cache.Fetch(downloadClient, req, "gitlab", c.baseUrl, c.project, tag, asset)
+}
+
+func (c *client) get(ctx context.Context, target string) ([]byte, http.Header, error) {
+	req, err := c.newRequest(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.cache.Client().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to download %s, status: %d", target, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.Header, err
+}
+
+func (c *client) newRequest(ctx context.Context, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" && c.isGitlabHost(req.URL) {
+		req.Header.Set("PRIVATE-TOKEN", c.token)
+	}
+	return req, nil
+}
+
+// isGitlabHost tells whether the target is served by the GitLab instance, asset links may point to any other host
+// which mustn't receive the token
+func (c *client) isGitlabHost(target *url.URL) bool {
+	base, err := url.Parse(c.baseUrl)
+	return err == nil && strings.EqualFold(base.Host, target.Host)
+}
+
+// dropCrossHostToken removes the PRIVATE-TOKEN header from redirects leaving the host of the original request,
+// net/http forwards the custom headers to any host
+func dropCrossHostToken(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("PRIVATE-TOKEN")
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package gitlab
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+const (
+	testProject  = "group/operator"
+	testToken    = "test-token"
+	testOperator = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+`
+	testCrd = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: things.example.com
+`
+)
+
+var (
+	testSigningKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testDownloads     atomic.Int32 // assets served by the last newTestGitlab with full content
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestFetchManifests(t *testing.T) {
+	//given
+	server := newTestGitlab(t, "v1.2.0")
+	cfg := common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		Assets:    []string{"operator.yaml", "crds.yaml"},
+		AuthToken: testToken,
+	}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	manifests, err := FetchManifests(context.Background(), nil, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	if manifests == nil {
+		t.Fatalf("FetchManifests() returned no manifests for a newer release")
+	}
+	if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+		t.Errorf("FetchManifests() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	if len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+		t.Errorf("FetchManifests() manifests = %d, crds = %d, want 1, 1", len(manifests.Manifests), len(manifests.Crds))
+	}
+}
+
+func TestFetchManifestsUpToDate(t *testing.T) {
+	//given
+	server := newTestGitlab(t, "v1.2.0")
+	cfg := common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		Assets:    []string{"operator.yaml"},
+		AuthToken: testToken,
+	}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	manifests, err := FetchManifests(context.Background(), nil, &cfg, &common.ReleasePolicy{}, &helmOps, "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	if manifests != nil {
+		t.Errorf("FetchManifests() = %v, want nil for an up to date chart", manifests)
+	}
+}
+
+func TestFetchManifestsMissingAsset(t *testing.T) {
+	//given
+	server := newTestGitlab(t, "v1.2.0")
+	cfg := common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		Assets:    []string{"missing.yaml"},
+		AuthToken: testToken,
+	}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	_, err := FetchManifests(context.Background(), nil, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil {
+		t.Errorf("FetchManifests() expected error for asset missing in release")
+	}
+}
+
+func TestFetchManifestsExternalAssetWithoutToken(t *testing.T) {
+	//given
+	var tokens atomic.Int32
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "" {
+			tokens.Add(1)
+		}
+		switch r.URL.Path {
+		case "/operator.yaml":
+			_, _ = w.Write([]byte(testOperator))
+		case "/redirect/operator.yaml":
+			http.Redirect(w, r, "/operator.yaml", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(external.Close)
+	server := newTestGitlab(t, "v1.2.0")
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/redirect/operator.yaml":
+			http.Redirect(w, r, external.URL+"/operator.yaml", http.StatusFound)
+		case strings.HasSuffix(r.URL.Path, "/releases/permalink/latest") && r.Header.Get("PRIVATE-TOKEN") == testToken:
+			_, _ = fmt.Fprintf(w, `{"tag_name": "v1.2.0", "assets": {"links": [
+  {"name": "operator.yaml", "url": "%s/redirect/operator.yaml"},
+  {"name": "redirected.yaml", "url": "%s/redirect/operator.yaml"}
+]}}`, external.URL, server.URL)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+	cfg := common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		Assets:    []string{"operator.yaml", "redirected.yaml"},
+		AuthToken: testToken,
+	}
+	helmOps := common.HelmOps{ChartName: "operator"}
+
+	//when
+	manifests, err := FetchManifests(context.Background(), nil, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	if len(manifests.Manifests) != 2 {
+		t.Errorf("FetchManifests() manifests = %d, want 2", len(manifests.Manifests))
+	}
+	if got := tokens.Load(); got != 0 {
+		t.Errorf("external host received PRIVATE-TOKEN %d times, want none", got)
+	}
+}
+
+func TestFetchManifestsVerified(t *testing.T) {
+	testCases := map[string]struct {
+		operator string
+		wantErr  bool
+	}{
+		"genuine":  {operator: testOperator},
+		"tampered": {operator: testOperator + "  namespace: evil\n", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			//given
+			server := newTestGitlab(t, "v1.2.0")
+			sums := fmt.Sprintf("%x  operator.yaml\n%x  crds.yaml\n", sha256.Sum256([]byte(testOperator)), sha256.Sum256([]byte(testCrd)))
+			serveVerificationFiles(t, server, sums, tc.operator)
+			publicKey, _ := x509.MarshalPKIXPublicKey(&testSigningKey.PublicKey)
+			cfg := common.GitlabSourceConfig{
+				BaseUrl:   server.URL,
+				Project:   testProject,
+				Assets:    []string{"operator.yaml", "crds.yaml"},
+				AuthToken: testToken,
+				Verify: &common.VerifyConfig{
+					Checksums:     "SHA256SUMS",
+					Signature:     "SHA256SUMS.sig",
+					SignatureType: common.SignatureCosign,
+					PublicKey:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+				},
+			}
+			helmOps := common.HelmOps{ChartName: "operator"}
+
+			//when
+			manifests, err := FetchManifests(context.Background(), nil, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+			//then
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("FetchManifests() expected verification error for tampered asset")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchManifests() error = %v", err)
+			}
+			if len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+				t.Errorf("FetchManifests() manifests = %d, crds = %d, want 1, 1", len(manifests.Manifests), len(manifests.Crds))
+			}
+		})
+	}
+}
+
+func TestFetchManifestsCached(t *testing.T) {
+	//given
+	server := newTestGitlab(t, "v1.2.0")
+	cfg := common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		Assets:    []string{"operator.yaml", "crds.yaml"},
+		AuthToken: testToken,
+	}
+	helmOps := common.HelmOps{ChartName: "operator"}
+	cacheDir := t.TempDir()
+
+	//when
+	cache := common.NewCache(cacheDir, false)
+	_, err := FetchManifests(context.Background(), cache, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+	if err != nil {
+		t.Fatalf("FetchManifests() error = %v", err)
+	}
+	_, err = FetchManifests(context.Background(), cache, &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+	if err != nil {
+		t.Fatalf("FetchManifests() revalidating error = %v", err)
+	}
+	server.Close()
+	manifests, err := FetchManifests(context.Background(), common.NewCache(cacheDir, true), &cfg, &common.ReleasePolicy{}, &helmOps, "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("FetchManifests() offline error = %v", err)
+	}
+	if manifests.AppVersion != "v1.2.0" || len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+		t.Errorf("FetchManifests() offline = %s with %d manifests, %d crds, want cached v1.2.0 with 1, 1", manifests.AppVersion, len(manifests.Manifests), len(manifests.Crds))
+	}
+	if downloads := testDownloads.Load(); downloads != 2 {
+		t.Errorf("assets downloaded %d times, want 2 as the cached ones are revalidated", downloads)
+	}
+}
+
+func TestListReleases(t *testing.T) {
+	//given
+	server := newTestGitlab(t, "v1.2.0")
+	source := NewGitlabSource(nil, &common.GitlabSourceConfig{
+		BaseUrl:   server.URL,
+		Project:   testProject,
+		AuthToken: testToken,
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	tags, err := source.ListReleases(context.Background())
+
+	//then
+	if err != nil {
+		t.Fatalf("ListReleases() error = %v", err)
+	}
+	if len(tags) != 3 {
+		t.Fatalf("ListReleases() = %v, want releases of both pages", tags)
+	}
+	backfilled, err := (&common.ReleasePolicy{Constraint: ">=1.1"}).Filter(tags)
+	if err != nil {
+		t.Fatalf("Filter() error = %v", err)
+	}
+	if fmt.Sprint(backfilled) != "[v1.1.0 v1.2.0]" {
+		t.Errorf("Filter() = %v, want [v1.1.0 v1.2.0]", backfilled)
+	}
+}
+
+// serveVerificationFiles replaces the operator.yaml served by the test server with operator
+// and serves the SHA256SUMS asset with its signature made by testSigningKey
+func serveVerificationFiles(t *testing.T, server *httptest.Server, sums, operator string) {
+	digest := sha256.Sum256([]byte(sums))
+	signature, err := ecdsa.SignASN1(rand.Reader, testSigningKey, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign checksums: %v", err)
+	}
+	files := map[string]string{
+		"/downloads/operator.yaml":  operator,
+		"/downloads/SHA256SUMS":     sums,
+		"/downloads/SHA256SUMS.sig": base64.StdEncoding.EncodeToString(signature),
+	}
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := files[r.URL.Path]; ok {
+			_, _ = w.Write([]byte(content))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// newTestGitlab serves the latest release of testProject with asset links (including verification files)
+// and the paginated list of its releases, requiring testToken
+func newTestGitlab(t *testing.T, tag string) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/api/v4/projects/group%2Foperator/releases" {
+			if r.URL.Query().Get("page") == "2" {
+				_, _ = w.Write([]byte(`[{"tag_name": "v1.0.0-rc.1"}]`))
+				return
+			}
+			w.Header().Set("X-Next-Page", "2")
+			_, _ = fmt.Fprintf(w, `[{"tag_name": %q}, {"tag_name": "v1.1.0"}]`, tag)
+			return
+		}
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Foperator/releases/permalink/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{
+  "tag_name": %q,
+  "assets": {
+    "links": [
+      {"name": "operator.yaml", "url": "%s/downloads/operator.yaml"},
+      {"name": "crds.yaml", "url": "%s/other", "direct_asset_url": "%s/downloads/crds.yaml"},
+      {"name": "SHA256SUMS", "url": "%s/downloads/SHA256SUMS"},
+      {"name": "SHA256SUMS.sig", "url": "%s/downloads/SHA256SUMS.sig"}
+    ]
+  }
+}`, tag, server.URL, server.URL, server.URL, server.URL, server.URL)
+	})
+	testDownloads.Store(0)
+	for name, content := range map[string]string{"operator.yaml": testOperator, "crds.yaml": testCrd} {
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(content)))
+		mux.HandleFunc("/downloads/"+name, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			testDownloads.Add(1)
+			_, _ = w.Write([]byte(content))
+		})
+	}
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
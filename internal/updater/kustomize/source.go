@@ -0,0 +1,129 @@
+// Package kustomize provides a ManifestSource that renders a kustomization
+// (local or from an upstream git tag) into the manifests stream.
+package kustomize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/kiemlicz/charter/internal/updater/git"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// KustomizeSource implements common.ManifestSource by running the equivalent of `kustomize build`.
+type KustomizeSource struct {
+	cache   *common.Cache
+	cfg     *common.KustomizeSourceConfig
+	release *common.ReleasePolicy
+	helm    *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeKustomize, common.SourceTraits{Versioned: true},
+		func(cfg *common.KustomizeSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			return NewKustomizeSource(env.Cache, cfg, release, helm), nil
+		})
+}
+
+// NewKustomizeSource constructs a KustomizeSource from the typed config blocks, upstream builds go through the cache.
+func NewKustomizeSource(cache *common.Cache, cfg *common.KustomizeSourceConfig, release *common.ReleasePolicy, helm *common.HelmOps) *KustomizeSource {
+	return &KustomizeSource{cache: cache, cfg: cfg, release: release, helm: helm}
+}
+
+func (s *KustomizeSource) ChartName() string        { return s.helm.ChartName }
+func (s *KustomizeSource) HelmOps() *common.HelmOps { return s.helm }
+
+// ListReleases returns the tags of the upstream repository, local kustomizations have no release history
+func (s *KustomizeSource) ListReleases(ctx context.Context) ([]string, error) {
+	if s.cfg.Git == nil {
+		return nil, fmt.Errorf("kustomizeSource: %s has no git repository to list releases of", s.helm.ChartName)
+	}
+	return git.ListTags(ctx, s.cache, s.cfg.Git.Url, s.cfg.Git.TagPattern)
+}
+
+// Fetch renders the kustomization of the upstream tag selected by the release policy (or the local one).
+// Returns (nil, nil) when the chart is already at that version.
+func (s *KustomizeSource) Fetch(ctx context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	remoteVersion := s.cfg.Version
+	if s.cfg.Git != nil {
+		tag, err := git.SelectTag(ctx, s.cache, s.cfg.Git.Url, s.cfg.Git.TagPattern, s.release)
+		if err != nil {
+			return nil, err
+		}
+		common.Log.Infof("Selected tag for %s: %s", s.cfg.Git.Url, tag)
+		remoteVersion = tag
+	}
+	if remoteVersion == "" {
+		return nil, fmt.Errorf("kustomizeSource: %s has neither git nor version configured", s.helm.ChartName)
+	}
+
+	if existingAppVersion == remoteVersion {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	normalizedVersion, err := s.release.Normalize(remoteVersion)
+	if err != nil {
+		return nil, err
+	}
+	version, err := common.TakeNewerVersion(existingVersion, normalizedVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", s.helm.ChartName, err)
+	}
+
+	rendered, err := s.render(ctx, remoteVersion)
+	if err != nil {
+		return nil, fmt.Errorf("kustomizeSource: failed to build %s: %w", s.cfg.Path, err)
+	}
+	common.Log.Infof("Rendered kustomization %s for %s, size: %d bytes", s.cfg.Path, s.helm.ChartName, len(rendered))
+
+	assetsData := map[string][]byte{s.cfg.Path: rendered}
+	manifests, err := common.NewManifests(&assetsData, version, remoteVersion, &s.helm.AddValues, &s.helm.AddCrdValues)
+	if err != nil {
+		common.Log.Errorf("Failed to collect manifests for %s: %v", s.helm.ChartName, err)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// render builds the kustomization of the upstream tag (or the local one). The builds of upstream tags are stored
+// in the cache, these include the remote resources the kustomization refers to, so that offline runs need no network.
+// Local kustomizations are built each time, their remote resources fail in offline mode.
+func (s *KustomizeSource) render(ctx context.Context, tag string) ([]byte, error) {
+	if s.cfg.Git == nil {
+		rendered, err := build(s.cfg.Path)
+		if err != nil && s.cache.Offline() {
+			return nil, fmt.Errorf("%w (remote resources of local kustomizations aren't available in offline mode)", err)
+		}
+		return rendered, err
+	}
+
+	return s.cache.Immutable(func() ([]byte, error) {
+		checkoutDir, err := os.MkdirTemp("", "charter-kustomize-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(checkoutDir)
+
+		// the build is cached, not the checkout
+		if err := git.CloneTag(ctx, nil, s.cfg.Git.Url, tag, osfs.New(checkoutDir)); err != nil {
+			return nil, err
+		}
+		return build(filepath.Join(checkoutDir, s.cfg.Path))
+	}, "kustomize", s.cfg.Git.Url, tag, s.cfg.Path)
+}
+
+// build renders the kustomization found in dir into a multi-document YAML stream
+func build(dir string) ([]byte, error) {
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resources, err := kustomizer.Run(filesys.MakeFsOnDisk(), dir)
+	if err != nil {
+		return nil, err
+	}
+	return resources.AsYaml()
+}
@@ -0,0 +1,72 @@
+package kustomize
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestFetch(t *testing.T) {
+	//given
+	source := NewKustomizeSource(nil, &common.KustomizeSourceConfig{
+		Path:    "testdata/overlay",
+		Version: "v1.2.0",
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+		t.Errorf("Fetch() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	names := make([]string, 0, len(manifests.Manifests))
+	for _, manifest := range manifests.Manifests {
+		names = append(names, common.ManifestKind(manifest)+"/"+common.FieldValue(manifest, "metadata", "namespace")+"/"+common.FieldValue(manifest, "metadata", "name"))
+	}
+	slices.Sort(names)
+	if expected := "Deployment/operator-system/example-operator,Service/operator-system/example-operator"; strings.Join(names, ",") != expected {
+		t.Errorf("Fetch() manifests = %v, want %s", names, expected)
+	}
+	for _, manifest := range manifests.Manifests {
+		if common.ManifestKind(manifest) != "Deployment" {
+			continue
+		}
+		containers := common.Field(manifest, "spec", "template", "spec", "containers")
+		if image := common.FieldValue(containers.Content[0], "image"); image != "example.com/operator:v1.2.0" {
+			t.Errorf("Fetch() image = %s, want the overlay's tag", image)
+		}
+	}
+	if len(manifests.Crds) != 1 || common.FieldValue(manifests.Crds[0], "metadata", "name") != "things.example.com" {
+		t.Errorf("Fetch() crds = %d, want the CRD of the base split out", len(manifests.Crds))
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	source := NewKustomizeSource(nil, &common.KustomizeSourceConfig{
+		Path:    "testdata/overlay",
+		Version: "v1.2.0",
+	}, &common.ReleasePolicy{}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil || manifests != nil {
+		t.Errorf("Fetch() = %v, %v, want nil for an up to date chart", manifests, err)
+	}
+}
@@ -0,0 +1,302 @@
+// Package olm provides a ManifestSource converting an Operator Lifecycle Manager bundle
+// (bundle directory or the filesystem of a bundle image) into plain manifests.
+package olm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+const (
+	ManifestsDir              = "manifests"
+	ClusterServiceVersion     = "ClusterServiceVersion"
+	DeploymentInstallStrategy = "deployment"
+	// ReleaseNamespace is the namespace of the service account subjects, the one the chart is installed into
+	ReleaseNamespace = "{{ .Release.Namespace }}"
+)
+
+// field is a key and value of a mapping node built by mapping
+type field struct {
+	key   string
+	value *yqlib.CandidateNode
+}
+
+// permission is a (cluster) permission entry of the CSV
+type permission struct {
+	serviceAccountName string
+	rules              []*yqlib.CandidateNode
+}
+
+// Bundle holds the manifests converted from an OLM bundle
+type Bundle struct {
+	Name      string
+	Version   string
+	Manifests []*yqlib.CandidateNode
+}
+
+// OlmSource implements common.ManifestSource backed by an OLM bundle.
+type OlmSource struct {
+	cfg  *common.OlmSourceConfig
+	helm *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeOlm, common.SourceTraits{},
+		func(cfg *common.OlmSourceConfig, _ *common.ReleasePolicy, helm *common.HelmOps, _ *common.SourceEnv) (common.ManifestSource, error) {
+			return NewOlmSource(cfg, helm), nil
+		})
+}
+
+// NewOlmSource constructs an OlmSource from the typed config blocks.
+func NewOlmSource(cfg *common.OlmSourceConfig, helm *common.HelmOps) *OlmSource {
+	return &OlmSource{cfg: cfg, helm: helm}
+}
+
+func (s *OlmSource) ChartName() string        { return s.helm.ChartName }
+func (s *OlmSource) HelmOps() *common.HelmOps { return s.helm }
+
+// Fetch converts the bundle into manifests versioned after the ClusterServiceVersion.
+// Returns (nil, nil) when the chart is already at the CSV's version.
+func (s *OlmSource) Fetch(_ context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	bundle, err := ReadBundle(s.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	common.Log.Infof("Read OLM bundle %s, version: %s", bundle.Name, bundle.Version)
+
+	if existingAppVersion == bundle.Version {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	version, err := common.TakeNewerVersion(existingVersion, bundle.Version)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", bundle.Name, err)
+	}
+
+	return common.NewManifestsOf(bundle.Manifests, version, bundle.Version, &s.helm.AddValues, &s.helm.AddCrdValues), nil
+}
+
+// ReadBundle converts the bundle found in dir (manifests/ sub-directory) into plain manifests:
+// CSV's deployments become Deployments, its (cluster) permissions become ServiceAccounts, (Cluster)Roles and their bindings
+// to the service accounts in the release namespace. CRDs are kept when owned by the CSV, other bundle objects are kept as they are.
+// The converted resources keep the key order and comments of the CSV's specs.
+func ReadBundle(dir string) (*Bundle, error) {
+	manifestsDir := filepath.Join(dir, ManifestsDir)
+	files, err := os.ReadDir(manifestsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OLM bundle manifests %s: %w", manifestsDir, err)
+	}
+
+	var csv *yqlib.CandidateNode
+	crds := make([]*yqlib.CandidateNode, 0)
+	others := make([]*yqlib.CandidateNode, 0)
+	for _, file := range files {
+		if file.IsDir() || !(strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml")) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(manifestsDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		docs, err := common.ExtractManifests(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OLM bundle file %s: %w", file.Name(), err)
+		}
+		for _, doc := range docs {
+			switch common.ManifestKind(doc) {
+			case ClusterServiceVersion:
+				if csv != nil {
+					return nil, fmt.Errorf("OLM bundle %s contains more than one %s", dir, ClusterServiceVersion)
+				}
+				csv = doc
+			case "CustomResourceDefinition":
+				crds = append(crds, doc)
+			default:
+				others = append(others, doc)
+			}
+		}
+	}
+	if csv == nil {
+		return nil, fmt.Errorf("OLM bundle %s contains no %s", dir, ClusterServiceVersion)
+	}
+	name := common.FieldValue(csv, "metadata", "name")
+	version := common.FieldValue(csv, "spec", "version")
+	if version == "" {
+		return nil, fmt.Errorf("%s %s has no version", ClusterServiceVersion, name)
+	}
+	if strategy := common.FieldValue(csv, "spec", "install", "strategy"); strategy != DeploymentInstallStrategy {
+		return nil, fmt.Errorf("%s %s has unsupported install strategy: %q", ClusterServiceVersion, name, strategy)
+	}
+	if webhooks := items(csv, "spec", "webhookdefinitions"); len(webhooks) > 0 {
+		common.Log.Warnf("%s %s defines %d webhooks, these are not converted", ClusterServiceVersion, name, len(webhooks))
+	}
+
+	manifests := make([]*yqlib.CandidateNode, 0)
+	manifests = append(manifests, ownedCrds(csv, crds)...)
+	manifests = append(manifests, rbac(csv)...)
+	for _, deployment := range items(csv, "spec", "install", "spec", "deployments") {
+		metadata := []field{{"name", scalar(common.FieldValue(deployment, "name"))}}
+		if label := common.Field(deployment, "label"); label != nil && len(label.Content) > 0 {
+			metadata = append(metadata, field{"labels", label})
+		}
+		spec := common.Field(deployment, "spec")
+		if spec == nil {
+			spec = mapping()
+		}
+		manifests = append(manifests, mapping(
+			field{"apiVersion", scalar("apps/v1")},
+			field{common.Kind, scalar("Deployment")},
+			field{"metadata", mapping(metadata...)},
+			field{"spec", spec},
+		))
+	}
+	manifests = append(manifests, others...)
+
+	return &Bundle{
+		Name:      name,
+		Version:   version,
+		Manifests: manifests,
+	}, nil
+}
+
+// ownedCrds returns the CRDs owned by the CSV, all of them if the CSV doesn't list any
+func ownedCrds(csv *yqlib.CandidateNode, crds []*yqlib.CandidateNode) []*yqlib.CandidateNode {
+	owned := items(csv, "spec", "customresourcedefinitions", "owned")
+	if len(owned) == 0 {
+		return crds
+	}
+	names := make(map[string]bool, len(owned))
+	for _, crd := range owned {
+		names[common.FieldValue(crd, "name")] = true
+	}
+	selected := make([]*yqlib.CandidateNode, 0, len(owned))
+	for _, crd := range crds {
+		if name := common.FieldValue(crd, "metadata", "name"); names[name] {
+			selected = append(selected, crd)
+		} else {
+			common.Log.Infof("Skipping CRD %s not owned by %s", name, common.FieldValue(csv, "metadata", "name"))
+		}
+	}
+	return selected
+}
+
+// rbac converts the CSV's permissions into ServiceAccounts, (Cluster)Roles and (Cluster)RoleBindings,
+// the roles are named after their service accounts, the cluster-scoped ones prefixed with the CSV name to avoid clashes between releases
+func rbac(csv *yqlib.CandidateNode) []*yqlib.CandidateNode {
+	clusterPermissions := permissions(csv, "clusterPermissions")
+	namespacedPermissions := permissions(csv, "permissions")
+	manifests := make([]*yqlib.CandidateNode, 0)
+	serviceAccounts := make(map[string]bool)
+	for _, perms := range [][]permission{clusterPermissions, namespacedPermissions} {
+		for _, p := range perms {
+			if serviceAccounts[p.serviceAccountName] {
+				continue
+			}
+			serviceAccounts[p.serviceAccountName] = true
+			manifests = append(manifests, mapping(
+				field{"apiVersion", scalar("v1")},
+				field{common.Kind, scalar("ServiceAccount")},
+				field{"metadata", mapping(field{"name", scalar(p.serviceAccountName)})},
+			))
+		}
+	}
+
+	manifests = append(manifests, roles(clusterPermissions, "ClusterRole", common.FieldValue(csv, "metadata", "name")+"-")...)
+	manifests = append(manifests, roles(namespacedPermissions, "Role", "")...)
+	return manifests
+}
+
+// permissions reads the permission entries under the key of the CSV's install spec
+func permissions(csv *yqlib.CandidateNode, key string) []permission {
+	entries := items(csv, "spec", "install", "spec", key)
+	perms := make([]permission, 0, len(entries))
+	for _, entry := range entries {
+		perms = append(perms, permission{
+			serviceAccountName: common.FieldValue(entry, "serviceAccountName"),
+			rules:              items(entry, "rules"),
+		})
+	}
+	return perms
+}
+
+func roles(permissions []permission, kind, namePrefix string) []*yqlib.CandidateNode {
+	// entries of the same service account are merged into a single role
+	merged := make([]permission, 0, len(permissions))
+	indexes := make(map[string]int, len(permissions))
+	for _, p := range permissions {
+		if i, ok := indexes[p.serviceAccountName]; ok {
+			merged[i].rules = append(merged[i].rules, p.rules...)
+			continue
+		}
+		indexes[p.serviceAccountName] = len(merged)
+		merged = append(merged, permission{serviceAccountName: p.serviceAccountName, rules: slices.Clone(p.rules)})
+	}
+
+	manifests := make([]*yqlib.CandidateNode, 0, 2*len(merged))
+	for _, p := range merged {
+		name := namePrefix + p.serviceAccountName
+		manifests = append(manifests,
+			mapping(
+				field{"apiVersion", scalar("rbac.authorization.k8s.io/v1")},
+				field{common.Kind, scalar(kind)},
+				field{"metadata", mapping(field{"name", scalar(name)})},
+				field{"rules", sequence(p.rules...)},
+			),
+			mapping(
+				field{"apiVersion", scalar("rbac.authorization.k8s.io/v1")},
+				field{common.Kind, scalar(fmt.Sprintf("%sBinding", kind))},
+				field{"metadata", mapping(field{"name", scalar(name)})},
+				field{"roleRef", mapping(
+					field{"apiGroup", scalar("rbac.authorization.k8s.io")},
+					field{"kind", scalar(kind)},
+					field{"name", scalar(name)},
+				)},
+				field{"subjects", sequence(mapping(
+					field{"kind", scalar("ServiceAccount")},
+					field{"name", scalar(p.serviceAccountName)},
+					field{"namespace", scalar(ReleaseNamespace)},
+				))},
+			),
+		)
+	}
+	return manifests
+}
+
+// items returns the entries of the sequence under the keys of the node, nil when absent
+func items(node *yqlib.CandidateNode, keys ...string) []*yqlib.CandidateNode {
+	sequence := common.Field(node, keys...)
+	if sequence == nil || sequence.Kind != yqlib.SequenceNode {
+		return nil
+	}
+	return sequence.Content
+}
+
+func scalar(value string) *yqlib.CandidateNode {
+	return &yqlib.CandidateNode{Kind: yqlib.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// mapping builds a mapping node of the fields, the values are copied keeping their comments
+func mapping(fields ...field) *yqlib.CandidateNode {
+	node := &yqlib.CandidateNode{Kind: yqlib.MappingNode, Tag: "!!map"}
+	for _, f := range fields {
+		node.AddKeyValueChild(scalar(f.key), f.value)
+	}
+	return node
+}
+
+// sequence builds a sequence node of the copied items
+func sequence(items ...*yqlib.CandidateNode) *yqlib.CandidateNode {
+	node := &yqlib.CandidateNode{Kind: yqlib.SequenceNode, Tag: "!!seq"}
+	for _, item := range items {
+		node.AddChild(item)
+	}
+	return node
+}
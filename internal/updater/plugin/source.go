@@ -0,0 +1,118 @@
+// Package plugin provides a ManifestSource delegating to an external program speaking the exec protocol,
+// for bespoke upstream origins that don't belong to charter itself.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// ExecSource implements common.ManifestSource backed by an external program.
+type ExecSource struct {
+	cfg  *common.ExecSourceConfig
+	helm *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeExec, common.SourceTraits{},
+		func(cfg *common.ExecSourceConfig, _ *common.ReleasePolicy, helm *common.HelmOps, _ *common.SourceEnv) (common.ManifestSource, error) {
+			return NewExecSource(cfg, helm), nil
+		})
+}
+
+// NewExecSource constructs an ExecSource from the typed config blocks.
+func NewExecSource(cfg *common.ExecSourceConfig, helm *common.HelmOps) *ExecSource {
+	return &ExecSource{cfg: cfg, helm: helm}
+}
+
+func (s *ExecSource) ChartName() string        { return s.helm.ChartName }
+func (s *ExecSource) HelmOps() *common.HelmOps { return s.helm }
+
+// Fetch runs the program with the existing chart's versions and collects the manifests it responds with.
+// Returns (nil, nil) when the program reports the chart is up to date.
+func (s *ExecSource) Fetch(ctx context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	response, err := s.run(ctx, &common.ExecRequest{
+		ProtocolVersion:   common.ExecProtocolVersion,
+		ChartName:         s.helm.ChartName,
+		CurrentVersion:    existingVersion,
+		CurrentAppVersion: existingAppVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("exec source of %s failed: %w", s.helm.ChartName, err)
+	}
+
+	if !response.UpToDate && response.AppVersion == "" {
+		return nil, fmt.Errorf("exec source of %s responded without appVersion", s.helm.ChartName)
+	}
+	if response.UpToDate || (existingAppVersion != "" && existingAppVersion == response.AppVersion) {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+	common.Log.Infof("Exec source of %s responded with version: %s", s.helm.ChartName, response.AppVersion)
+
+	remoteVersion := response.Version
+	if remoteVersion == "" {
+		remoteVersion = response.AppVersion
+	}
+	version, err := common.TakeNewerVersion(existingVersion, remoteVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", s.helm.ChartName, err)
+	}
+
+	assetsData := make(map[string][]byte, len(response.Manifests))
+	for i, manifest := range response.Manifests {
+		assetsData[fmt.Sprintf("%s-%d.yaml", s.helm.ChartName, i)] = []byte(manifest)
+	}
+	manifests, err := common.NewManifests(&assetsData, version, response.AppVersion, &s.helm.AddValues, &s.helm.AddCrdValues)
+	if err != nil {
+		common.Log.Errorf("Failed to collect manifests for %s: %v", s.helm.ChartName, err)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// run executes the program with the request on stdin and decodes its response
+func (s *ExecSource) run(ctx context.Context, request *common.ExecRequest) (*common.ExecResponse, error) {
+	if s.cfg.Command == "" {
+		return nil, fmt.Errorf("command is empty")
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, s.cfg.Command, s.cfg.Args...)
+	cmd.Dir = s.cfg.Dir
+	cmd.Env = os.Environ()
+	for name, value := range s.cfg.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if stderr.Len() > 0 {
+		common.Log.Infof("%s: %s", s.cfg.Command, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.cfg.Command, err)
+	}
+
+	var response common.ExecResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("malformed response of %s: %w", s.cfg.Command, err)
+	}
+	if response.ProtocolVersion != common.ExecProtocolVersion {
+		return nil, fmt.Errorf("%s responded with protocol version %q, expected %q", s.cfg.Command, response.ProtocolVersion, common.ExecProtocolVersion)
+	}
+	return &response, nil
+}
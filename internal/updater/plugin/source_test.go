@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+// testPlugin responds with the up to date flag for the app version v1.2.0, with the v1.2.0 manifests otherwise
+const testPlugin = `
+request=$(cat)
+case "$request" in
+  *'"currentAppVersion":"v1.2.0"'*)
+    echo '{"protocolVersion": "charter.exec/v1", "upToDate": true}' ;;
+  *)
+    echo 'fetching manifests' >&2
+    printf '%s' '{"protocolVersion": "charter.exec/v1", "appVersion": "v1.2.0", "manifests": ["apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: operator\n---\napiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: things.example.com\n"]}' ;;
+esac
+`
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+func TestFetch(t *testing.T) {
+	//given
+	source := NewExecSource(&common.ExecSourceConfig{Command: "sh", Args: []string{"-c", testPlugin}}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests == nil {
+		t.Fatalf("Fetch() returned no manifests for a newer release")
+	}
+	if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+		t.Errorf("Fetch() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+	}
+	if len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+		t.Errorf("Fetch() manifests = %d, crds = %d, want 1, 1", len(manifests.Manifests), len(manifests.Crds))
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	source := NewExecSource(&common.ExecSourceConfig{Command: "sh", Args: []string{"-c", testPlugin}}, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests != nil {
+		t.Errorf("Fetch() = %v, want nil for an up to date chart", manifests)
+	}
+}
+
+func TestFetchProtocolMismatch(t *testing.T) {
+	//given
+	cfg := common.ExecSourceConfig{Command: "sh", Args: []string{"-c", `echo '{"protocolVersion": "charter.exec/v0", "upToDate": true}'`}}
+	source := NewExecSource(&cfg, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	_, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil {
+		t.Errorf("Fetch() expected error for unsupported protocol version")
+	}
+}
+
+func TestFetchWithoutAppVersion(t *testing.T) {
+	//given
+	cfg := common.ExecSourceConfig{Command: "sh", Args: []string{"-c", `echo '{"protocolVersion": "charter.exec/v1", "manifests": []}'`}}
+	source := NewExecSource(&cfg, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "", "")
+
+	//then
+	if err == nil {
+		t.Errorf("Fetch() = %v, expected error for response without appVersion of a chart not generated yet", manifests)
+	}
+}
+
+func TestFetchFailure(t *testing.T) {
+	//given
+	cfg := common.ExecSourceConfig{Command: "sh", Args: []string{"-c", "echo 'upstream unreachable' >&2; exit 3"}}
+	source := NewExecSource(&cfg, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	_, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+	//then
+	if err == nil {
+		t.Errorf("Fetch() expected error for failed program")
+	}
+}
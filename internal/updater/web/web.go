@@ -0,0 +1,159 @@
+// Package web provides a ManifestSource for manifests published on plain web servers
+// or object storage buckets (GCS, S3), with the upstream version discovered from a URL.
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/kiemlicz/charter/internal/common"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+)
+
+// HttpSource implements common.ManifestSource backed by plain HTTP(S) URLs.
+type HttpSource struct {
+	cache *common.Cache
+	cfg   *common.HttpSourceConfig
+	helm  *common.HelmOps
+}
+
+func init() {
+	common.RegisterSource(common.SourceTypeHttp, common.SourceTraits{},
+		func(cfg *common.HttpSourceConfig, _ *common.ReleasePolicy, helm *common.HelmOps, env *common.SourceEnv) (common.ManifestSource, error) {
+			return NewHttpSource(env.Cache, cfg, helm), nil
+		})
+}
+
+// NewHttpSource constructs a HttpSource from the typed config blocks, downloading through the cache.
+func NewHttpSource(cache *common.Cache, cfg *common.HttpSourceConfig, helm *common.HelmOps) *HttpSource {
+	return &HttpSource{cache: cache, cfg: cfg, helm: helm}
+}
+
+func (s *HttpSource) ChartName() string        { return s.helm.ChartName }
+func (s *HttpSource) HelmOps() *common.HelmOps { return s.helm }
+
+// Fetch resolves the upstream version from VersionUrl and downloads the rendered asset URLs.
+// Returns (nil, nil) when the chart is already at the discovered version.
+func (s *HttpSource) Fetch(ctx context.Context, existingVersion, existingAppVersion string) (*common.Manifests, error) {
+	remoteVersion, err := s.discoverVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("httpSource: version discovery for %s failed: %w", s.helm.ChartName, err)
+	}
+	common.Log.Infof("Latest version for %s: %s", s.helm.ChartName, remoteVersion)
+
+	if existingAppVersion == remoteVersion {
+		common.Log.Infof("Helm chart %s is already up to date with version %s", s.helm.ChartName, existingAppVersion)
+		return nil, nil
+	}
+
+	version, err := common.TakeNewerVersion(existingVersion, remoteVersion)
+	if err != nil {
+		return nil, fmt.Errorf("version resolution failed for %s: %w", s.helm.ChartName, err)
+	}
+
+	assetsData := make(map[string][]byte)
+	for _, assetTemplate := range s.cfg.Assets {
+		assetUrl, err := renderUrl(assetTemplate, remoteVersion)
+		if err != nil {
+			return nil, err
+		}
+		name := assetName(assetUrl)
+		if _, duplicate := assetsData[name]; duplicate {
+			return nil, fmt.Errorf("httpSource: asset %s of %s has the same path as another asset", assetUrl, s.helm.ChartName)
+		}
+		data, err := s.download(ctx, assetUrl, "http", s.helm.ChartName, remoteVersion, name)
+		if err != nil {
+			common.Log.Errorf("Failed to download asset %s for %s: %v", assetUrl, s.helm.ChartName, err)
+			return nil, err
+		}
+		common.Log.Infof("Downloaded asset %s for %s, size: %d bytes", assetUrl, s.helm.ChartName, len(data))
+		assetsData[name] = data
+	}
+
+	manifests, err := common.NewManifests(&assetsData, version, remoteVersion, &s.helm.AddValues, &s.helm.AddCrdValues)
+	if err != nil {
+		common.Log.Errorf("Failed to collect manifests for %s: %v", s.helm.ChartName, err)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// discoverVersion reads VersionUrl, the whole (trimmed) body is the version unless VersionQuery is set
+func (s *HttpSource) discoverVersion(ctx context.Context) (string, error) {
+	if s.cfg.VersionUrl == "" {
+		return "", fmt.Errorf("versionUrl is empty")
+	}
+	body, err := s.download(ctx, s.cfg.VersionUrl)
+	if err != nil {
+		return "", err
+	}
+	if s.cfg.VersionQuery == "" {
+		return strings.TrimSpace(string(body)), nil
+	}
+
+	// JSON is a subset of YAML, the YAML decoder handles both
+	prefs := yqlib.NewDefaultYamlPreferences()
+	result, err := yqlib.NewStringEvaluator().Evaluate(
+		s.cfg.VersionQuery,
+		string(body),
+		yqlib.NewYamlEncoder(prefs),
+		yqlib.NewYamlDecoder(prefs),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate versionQuery '%s': %w", s.cfg.VersionQuery, err)
+	}
+	version := strings.TrimSpace(result)
+	if version == "" || version == "null" {
+		return "", fmt.Errorf("versionQuery '%s' selected no version", s.cfg.VersionQuery)
+	}
+	return version, nil
+}
+
+func renderUrl(urlTemplate, version string) (string, error) {
+	tmpl, err := template.New("asset").Option("missingkey=error").Parse(urlTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid asset URL template '%s': %w", urlTemplate, err)
+	}
+	out := new(bytes.Buffer)
+	if err := tmpl.Execute(out, struct{ Version string }{Version: version}); err != nil {
+		return "", fmt.Errorf("failed to render asset URL template '%s': %w", urlTemplate, err)
+	}
+	return out.String(), nil
+}
+
+// assetName is the full path of the asset URL, assets of the same file name in different directories don't collide
+func assetName(assetUrl string) string {
+	u, err := url.Parse(assetUrl)
+	if err != nil {
+		return assetUrl
+	}
+	return strings.TrimPrefix(path.Clean(u.Path), "/")
+}
+
+// download fetches target through the cache, under the key when given, by URL (revalidated each time) otherwise
+func (s *HttpSource) download(ctx context.Context, target string, key ...string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		return s.cache.Fetch(http.DefaultClient, req, key...)
+	}
+	resp, err := s.cache.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s, status: %d", target, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
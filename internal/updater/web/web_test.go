@@ -0,0 +1,154 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kiemlicz/charter/internal/common"
+)
+
+const (
+	testOperator = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator
+`
+	testCrd = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: things.example.com
+`
+)
+
+// BeforeAll
+func TestMain(m *testing.M) {
+	common.Setup("debug")
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the stable version as text, the release metadata as JSON and the assets of v1.2.0
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stable.txt", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("v1.2.0\n"))
+	})
+	mux.HandleFunc("/release.json", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"name": "operator", "release": {"tag": "v1.2.0"}}`))
+	})
+	mux.HandleFunc("/v1.2.0/operator.yaml", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testOperator))
+	})
+	mux.HandleFunc("/v1.2.0/crds/operator.yaml", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCrd))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetch(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name string
+		cfg  common.HttpSourceConfig
+	}{
+		{"text version", common.HttpSourceConfig{VersionUrl: server.URL + "/stable.txt"}},
+		{"json version", common.HttpSourceConfig{VersionUrl: server.URL + "/release.json", VersionQuery: ".release.tag"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			cfg := tt.cfg
+			cfg.Assets = []string{server.URL + "/{{ .Version }}/operator.yaml", server.URL + "/{{ .Version }}/crds/operator.yaml"}
+			source := NewHttpSource(nil, &cfg, &common.HelmOps{ChartName: "operator"})
+
+			//when
+			manifests, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+			//then
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if manifests == nil {
+				t.Fatalf("Fetch() returned no manifests for a newer release")
+			}
+			if manifests.AppVersion != "v1.2.0" || manifests.Version.String() != "1.2.0" {
+				t.Errorf("Fetch() version = %s, appVersion = %s, want 1.2.0, v1.2.0", manifests.Version.String(), manifests.AppVersion)
+			}
+			if len(manifests.Manifests) != 1 || len(manifests.Crds) != 1 {
+				t.Errorf("Fetch() manifests = %d, crds = %d, want 1, 1 from the assets of the same file name", len(manifests.Manifests), len(manifests.Crds))
+			}
+		})
+	}
+}
+
+func TestFetchUpToDate(t *testing.T) {
+	//given
+	server := newTestServer(t)
+	cfg := common.HttpSourceConfig{
+		VersionUrl: server.URL + "/stable.txt",
+		Assets:     []string{server.URL + "/{{ .Version }}/missing.yaml"},
+	}
+	source := NewHttpSource(nil, &cfg, &common.HelmOps{ChartName: "operator"})
+
+	//when
+	manifests, err := source.Fetch(context.Background(), "1.2.0", "v1.2.0")
+
+	//then
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if manifests != nil {
+		t.Errorf("Fetch() = %v, want nil for an up to date chart", manifests)
+	}
+}
+
+func TestFetchInvalid(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name    string
+		cfg     common.HttpSourceConfig
+		wantErr string
+	}{
+		{"query selecting nothing", common.HttpSourceConfig{VersionUrl: server.URL + "/release.json", VersionQuery: ".version"}, "selected no version"},
+		{"unknown template key", common.HttpSourceConfig{VersionUrl: server.URL + "/stable.txt", Assets: []string{server.URL + "/{{ .Tag }}/operator.yaml"}}, "failed to render"},
+		{"missing asset", common.HttpSourceConfig{VersionUrl: server.URL + "/stable.txt", Assets: []string{server.URL + "/{{ .Version }}/missing.yaml"}}, "status: 404"},
+		{"duplicate asset path", common.HttpSourceConfig{VersionUrl: server.URL + "/stable.txt", Assets: []string{server.URL + "/{{ .Version }}/operator.yaml", server.URL + "/{{ .Version }}/operator.yaml?mirror"}}, "same path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//given
+			source := NewHttpSource(nil, &tt.cfg, &common.HelmOps{ChartName: "operator"})
+
+			//when
+			_, err := source.Fetch(context.Background(), "1.1.0", "v1.1.0")
+
+			//then
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Fetch() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenderUrl(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"https://example.com/{{ .Version }}/operator.yaml", "https://example.com/v1.2.0/operator.yaml"},
+		{"https://example.com/operator-{{ .Version | printf \"%.4s\" }}.yaml", "https://example.com/operator-v1.2.yaml"},
+		{"https://example.com/latest/operator.yaml", "https://example.com/latest/operator.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if got, err := renderUrl(tt.template, "v1.2.0"); err != nil || got != tt.want {
+				t.Errorf("renderUrl() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}